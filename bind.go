@@ -0,0 +1,181 @@
+package queries
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// PrepareFromAny prepares the arguments from either a map with string keys
+// or a struct (or pointer to struct). Struct fields are matched to parameters
+// by their `db` tag, falling back to a case-insensitive field name match
+func (q *Query) PrepareFromAny(v any) ([]interface{}, error) {
+	if args, ok := v.(map[string]interface{}); ok {
+		return q.Prepare(args), nil
+	}
+
+	rv, err := q.indirect(v)
+	if err != nil {
+		return nil, err
+	}
+
+	switch rv.Kind() {
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			return nil, fmt.Errorf("Cannot bind arguments of query '%s' from %s: keys must be strings", q.Name, rv.Type())
+		}
+
+		args := make(map[string]interface{}, rv.Len())
+		iter := rv.MapRange()
+		for iter.Next() {
+			args[iter.Key().String()] = iter.Value().Interface()
+		}
+
+		return q.Prepare(args), nil
+	case reflect.Struct:
+		args, err := q.structArgs(rv)
+		if err != nil {
+			return nil, err
+		}
+
+		return q.Prepare(args), nil
+	}
+
+	return nil, fmt.Errorf("Cannot bind arguments of query '%s' from %T", q.Name, v)
+}
+
+// PrepareStruct prepares the arguments from a struct (or pointer to struct).
+// Fields are matched to parameters by their `db` tag, falling back to
+// a case-insensitive field name match; unexported fields are ignored.
+// A parameter without a matching field is an error naming the parameter
+func (q *Query) PrepareStruct(v interface{}) ([]interface{}, error) {
+	rv, err := q.indirect(v)
+	if err != nil {
+		return nil, err
+	}
+
+	if rv.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("Cannot bind arguments of query '%s' from %T: not a struct", q.Name, v)
+	}
+
+	args, err := q.structArgs(rv)
+	if err != nil {
+		return nil, err
+	}
+
+	return q.Prepare(args), nil
+}
+
+// indirect dereferences pointers to the value they point to
+func (q *Query) indirect(v interface{}) (reflect.Value, error) {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Pointer {
+		if rv.IsNil() {
+			return rv, fmt.Errorf("Cannot bind arguments of query '%s' from nil %s", q.Name, rv.Type())
+		}
+		rv = rv.Elem()
+	}
+
+	return rv, nil
+}
+
+// PrepareJSON prepares the arguments from a JSON object. JSON numbers are
+// bound as float64 unless the query was compiled WithJSONNumbers
+func (q *Query) PrepareJSON(data []byte) ([]interface{}, error) {
+	var args map[string]interface{}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if q.options().jsonNumbers {
+		decoder.UseNumber()
+	}
+
+	if err := decoder.Decode(&args); err != nil {
+		return nil, fmt.Errorf("Cannot bind arguments of query '%s' from JSON: %v", q.Name, err)
+	}
+
+	for name, value := range args {
+		if number, ok := value.(json.Number); ok {
+			args[name] = jsonNumber(number)
+		}
+	}
+
+	return q.Prepare(args), nil
+}
+
+// jsonNumber converts the number to int64 when it is integral and to float64
+// otherwise
+func jsonNumber(number json.Number) interface{} {
+	if i, err := number.Int64(); err == nil {
+		return i
+	}
+
+	if f, err := number.Float64(); err == nil {
+		return f
+	}
+
+	return number.String()
+}
+
+// structArgs collects the values of struct fields matching the query
+// parameters. Parameters without a field are left to their default, resolver
+// or automatic value and fields behind a nil embedded pointer are nil
+func (q *Query) structArgs(rv reflect.Value) (map[string]interface{}, error) {
+	fields := reflect.VisibleFields(rv.Type())
+	args := make(map[string]interface{}, len(q.Mapping))
+
+	for name := range q.Mapping {
+		field, ok := findField(fields, name)
+		if !ok && q.resolvable(name) {
+			continue
+		}
+		if !ok {
+			return nil, fmt.Errorf("Parameter '%s' of query '%s' has no matching field in %s", name, q.Name, rv.Type())
+		}
+
+		// fields promoted through a nil embedded pointer are bound as NULL
+		value, err := rv.FieldByIndexErr(field.Index)
+		if err != nil {
+			args[name] = nil
+			continue
+		}
+		args[name] = value.Interface()
+	}
+
+	return args, nil
+}
+
+// resolvable reports whether the parameter is bound without an argument
+func (q *Query) resolvable(name string) bool {
+	_, ok := q.lookupArgument(func(string) (interface{}, bool) { return nil, false }, name)
+	return ok
+}
+
+// findField looks up the field for given parameter name, preferring the `db`
+// tag over the field name
+func findField(fields []reflect.StructField, name string) (reflect.StructField, bool) {
+	var (
+		fallback reflect.StructField
+		found    bool
+	)
+
+	for _, field := range fields {
+		if !field.IsExported() || field.Anonymous {
+			continue
+		}
+
+		tag, _, _ := strings.Cut(field.Tag.Get("db"), ",")
+		if tag == "-" {
+			continue
+		}
+		if tag == name {
+			return field, true
+		}
+		if tag == "" && !found && strings.EqualFold(field.Name, name) {
+			fallback, found = field, true
+		}
+	}
+
+	return fallback, found
+}
@@ -0,0 +1,197 @@
+package queries
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPrepareFromAny(t *testing.T) {
+	q := NewQuery("get-user", "SELECT * FROM users WHERE id = :id AND name = :name")
+	expected := []interface{}{10, "john"}
+
+	type user struct {
+		ID       int `db:"id"`
+		Name     string
+		internal string
+	}
+
+	testCases := []struct {
+		name  string
+		input any
+	}{
+		{name: "map", input: map[string]interface{}{"id": 10, "name": "john"}},
+		{name: "typed-map", input: map[string]any{"name": "john", "id": 10}},
+		{name: "struct", input: user{ID: 10, Name: "john"}},
+		{name: "struct-pointer", input: &user{ID: 10, Name: "john"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			args, err := q.PrepareFromAny(tc.input)
+			if err != nil {
+				t.Fatalf("PrepareFromAny: unexpected error %v", err)
+			}
+			if !reflect.DeepEqual(args, expected) {
+				t.Errorf("PrepareFromAny: got %v, expected %v", args, expected)
+			}
+		})
+	}
+}
+
+func TestPrepareFromAnyErrors(t *testing.T) {
+	q := NewQuery("get-user", "SELECT * FROM users WHERE id = :id")
+
+	testCases := []struct {
+		name  string
+		input any
+	}{
+		{name: "missing-field", input: struct{ Name string }{Name: "john"}},
+		{name: "nil-pointer", input: (*struct{ ID int })(nil)},
+		{name: "int-keys", input: map[int]interface{}{1: 10}},
+		{name: "scalar", input: 10},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := q.PrepareFromAny(tc.input); err == nil {
+				t.Errorf("PrepareFromAny(%v): expected error", tc.input)
+			}
+		})
+	}
+}
+
+func TestPrepareJSON(t *testing.T) {
+	query := "SELECT * FROM users WHERE id = :id AND name = :name AND active = :active AND deleted_at = :deleted_at AND score > :score"
+	data := []byte(`{"id": 12345678901, "name": "john", "active": true, "deleted_at": null, "score": 1.5}`)
+
+	testCases := []struct {
+		name     string
+		opts     []Option
+		expected []interface{}
+	}{
+		{
+			name:     "float",
+			expected: []interface{}{float64(12345678901), "john", true, nil, 1.5},
+		},
+		{
+			name:     "numbers",
+			opts:     []Option{WithJSONNumbers()},
+			expected: []interface{}{int64(12345678901), "john", true, nil, 1.5},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			args, err := NewQuery(tc.name, query, tc.opts...).PrepareJSON(data)
+			if err != nil {
+				t.Fatalf("PrepareJSON: unexpected error %v", err)
+			}
+			if !reflect.DeepEqual(args, tc.expected) {
+				t.Errorf("PrepareJSON: got %#v, expected %#v", args, tc.expected)
+			}
+		})
+	}
+
+	if _, err := NewQuery("array", query).PrepareJSON([]byte(`[1, 2]`)); err == nil {
+		t.Error("PrepareJSON: expected error for JSON array")
+	}
+}
+
+func TestPrepareStruct(t *testing.T) {
+	q := NewQuery("update-user", "UPDATE users SET name = :name, email = :email, updated_at = :@now WHERE id = :user_id")
+
+	type user struct {
+		ID     int `db:"user_id"`
+		Name   string
+		EMail  string
+		secret string
+	}
+
+	args, err := q.PrepareStruct(&user{ID: 7, Name: "alice", EMail: "alice@example.com", secret: "x"})
+	if err != nil {
+		t.Fatalf("PrepareStruct: unexpected error %v", err)
+	}
+	if len(args) != 4 || args[0] != "alice" || args[1] != "alice@example.com" || args[3] != 7 {
+		t.Errorf("PrepareStruct: unexpected arguments %v", args)
+	}
+
+	type partial struct {
+		ID   int `db:"user_id"`
+		Name string
+	}
+	_, err = q.PrepareStruct(partial{ID: 7, Name: "alice"})
+	if err == nil || !strings.Contains(err.Error(), "Parameter 'email'") {
+		t.Errorf("PrepareStruct: expected error naming email, got %v", err)
+	}
+
+	type hidden struct {
+		ID    int `db:"user_id"`
+		Name  string
+		email string
+	}
+	if _, err := q.PrepareStruct(hidden{}); err == nil {
+		t.Error("PrepareStruct: expected unexported field to be ignored")
+	}
+
+	if _, err := q.PrepareStruct(map[string]interface{}{"user_id": 7}); err == nil {
+		t.Error("PrepareStruct: expected error for a map")
+	}
+}
+
+func TestPrepareStructNilEmbedded(t *testing.T) {
+	type Inner struct {
+		Email string
+	}
+	type Outer struct {
+		*Inner
+		Name string
+	}
+
+	q := NewQuery("update-user", "UPDATE users SET name = :Name, email = :Email")
+
+	args, err := q.PrepareStruct(Outer{Name: "n"})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !reflect.DeepEqual(args, []interface{}{"n", nil}) {
+		t.Errorf("unexpected arguments %v", args)
+	}
+
+	args, err = q.PrepareStruct(Outer{Inner: &Inner{Email: "e"}, Name: "n"})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !reflect.DeepEqual(args, []interface{}{"n", "e"}) {
+		t.Errorf("unexpected arguments %v", args)
+	}
+}
+
+func TestPrepareStructResolved(t *testing.T) {
+	type filter struct {
+		Status string `db:"status"`
+	}
+
+	store := NewQueryStore(WithResolver(func(name string) (interface{}, bool) {
+		return 42, name == "tenant_id"
+	}))
+	if err := store.loadQueriesFromFile("users.sql", strings.NewReader("-- name: list-users\n-- default limit: 50\nSELECT * FROM users WHERE tenant_id = :tenant_id AND status = :status LIMIT :limit")); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	q := store.MustHaveQuery("list-users")
+
+	args, err := q.PrepareStruct(filter{Status: "active"})
+	if err != nil {
+		t.Fatalf("PrepareStruct: unexpected error %v", err)
+	}
+	if expected := []interface{}{42, "active", int64(50)}; !reflect.DeepEqual(args, expected) {
+		t.Errorf("expected %v, got %v", expected, args)
+	}
+	if args, err := q.PrepareFromAny(&filter{Status: "active"}); err != nil || !reflect.DeepEqual(args, []interface{}{42, "active", int64(50)}) {
+		t.Errorf("PrepareFromAny: got %v, %v", args, err)
+	}
+
+	if _, err := NewQuery("get-user", "SELECT * FROM users WHERE id = :id").PrepareStruct(filter{}); err == nil || !strings.Contains(err.Error(), "Parameter 'id'") {
+		t.Errorf("expected the missing field error, got %v", err)
+	}
+}
@@ -0,0 +1,558 @@
+package queries
+
+import (
+	"fmt"
+	"strings"
+)
+
+// keyword is a word found at the top level of a statement
+type keyword struct {
+	word       string
+	start, end int
+}
+
+var (
+	// whereTerminators end the WHERE clause of a statement
+	whereTerminators = map[string]bool{
+		"GROUP": true, "HAVING": true, "WINDOW": true, "ORDER": true,
+		"LIMIT": true, "OFFSET": true, "FETCH": true, "FOR": true,
+		"RETURNING": true, "UNION": true, "INTERSECT": true, "EXCEPT": true,
+		";": true,
+	}
+
+	// countTerminators end the part of a SELECT kept by CountQuery
+	countTerminators = map[string]bool{
+		"ORDER": true, "LIMIT": true, "OFFSET": true, "FETCH": true, "FOR": true,
+		";": true,
+	}
+
+	// countWrapped need the SELECT wrapped in a subquery to be counted
+	countWrapped = map[string]bool{
+		"DISTINCT": true, "GROUP": true, "HAVING": true, "WINDOW": true,
+		"UNION": true, "INTERSECT": true, "EXCEPT": true,
+	}
+)
+
+// WhereClause returns the top-level WHERE clause of the raw query, including
+// the WHERE keyword and its named parameters. This is a lightweight clause
+// detection, not a SQL parser: WHERE clauses of subqueries are ignored
+func (q *Query) WhereClause() (string, bool) {
+	keywords := topLevelKeywords(q.Raw)
+
+	for i, kw := range keywords {
+		if kw.word != "WHERE" {
+			continue
+		}
+
+		end := len(q.Raw)
+		for _, next := range keywords[i+1:] {
+			if whereTerminators[next.word] {
+				end = next.start
+				break
+			}
+		}
+
+		return strings.TrimSpace(q.Raw[kw.start:end]), true
+	}
+
+	return "", false
+}
+
+// CountQuery derives a `SELECT count(*)` query from the SELECT query, dropping
+// its ORDER BY, LIMIT and OFFSET. Grouped, distinct and compound selects are
+// counted through a subquery. The count query is named after the query with
+// a -count suffix and binds the same argument names
+func (q *Query) CountQuery() (*Query, error) {
+	keywords := topLevelKeywords(q.Raw)
+
+	selectAt := -1
+	for i, kw := range keywords {
+		if kw.word == "SELECT" {
+			selectAt = i
+			break
+		}
+	}
+	if selectAt < 0 {
+		return nil, fmt.Errorf("Query '%s' is not a SELECT", q.Name)
+	}
+
+	var (
+		from    = -1
+		end     = len(q.Raw)
+		wrapped bool
+	)
+
+	for _, kw := range keywords[selectAt+1:] {
+		if countTerminators[kw.word] {
+			end = kw.start
+			break
+		}
+		if countWrapped[kw.word] {
+			wrapped = true
+		}
+		if kw.word == "FROM" && from < 0 {
+			from = kw.start
+		}
+	}
+	if from < 0 {
+		return nil, fmt.Errorf("Query '%s' has no FROM clause", q.Name)
+	}
+
+	start := keywords[selectAt].start
+	prefix := q.Raw[:start]
+
+	var raw string
+	if wrapped {
+		raw = fmt.Sprintf("%sSELECT count(*) FROM (%s) AS counted", prefix, strings.TrimSpace(q.Raw[start:end]))
+	} else {
+		raw = fmt.Sprintf("%sSELECT count(*) %s", prefix, strings.TrimSpace(q.Raw[from:end]))
+	}
+
+	// the metadata is set before compiling, so the placeholder style is kept,
+	// and the defaults bind the same rows as the query
+	count := &Query{
+		Name:     q.Name + "-count",
+		Raw:      raw,
+		Metadata: q.Metadata,
+		Defaults: q.Defaults,
+		Source:   q.Source,
+		opts:     q.options(),
+	}
+	count.compile()
+
+	return count, nil
+}
+
+// Statements splits the ordinal query on top-level semicolons, keeping the
+// ordinals of the whole query, e.g. for logging. Semicolons in literals,
+// dollar quotes and comments do not split. Use SplitStatements to execute
+// the statements one by one
+func (q *Query) Statements() []string {
+	return splitStatements(q.body())
+}
+
+// SplitStatements splits the raw query on top-level semicolons and compiles
+// every statement as a query of its own, named after the query with a -N
+// suffix. The ordinals are renumbered per statement, so each statement is
+// prepared with only the parameters it uses
+func (q *Query) SplitStatements() []*Query {
+	var statements []*Query
+	for i, raw := range splitStatements(q.Raw) {
+		statement := &Query{
+			Name:     fmt.Sprintf("%s-%d", q.Name, i+1),
+			Raw:      raw,
+			Metadata: q.Metadata,
+			Defaults: q.Defaults,
+			Source:   q.Source,
+			opts:     q.options(),
+		}
+		statement.compile()
+
+		statements = append(statements, statement)
+	}
+
+	return statements
+}
+
+// splitStatements returns the trimmed non-empty statements separated by
+// top-level semicolons
+func splitStatements(sql string) []string {
+	var (
+		statements []string
+		last       int
+	)
+
+	add := func(statement string) {
+		if statement = strings.TrimSpace(statement); statement != "" {
+			statements = append(statements, statement)
+		}
+	}
+
+	for _, kw := range topLevelKeywords(sql) {
+		if kw.word == ";" {
+			add(sql[last:kw.start])
+			last = kw.end
+		}
+	}
+	add(sql[last:])
+
+	return statements
+}
+
+// topLevelKeywords returns the upper-cased words (and semicolons) found
+// outside of parentheses, literals, quoted identifiers and comments.
+// Parameter names are skipped
+func topLevelKeywords(sql string) []keyword {
+	var (
+		keywords []keyword
+		depth    int
+	)
+
+	for i := 0; i < len(sql); {
+		c := sql[i]
+
+		switch {
+		case c == '\'' || c == '"':
+			i = skipQuoted(sql, i, c)
+		case c == '$':
+			i = skipDollarQuoted(sql, i)
+		case strings.HasPrefix(sql[i:], "--"):
+			i = skipLineComment(sql, i)
+		case strings.HasPrefix(sql[i:], "/*"):
+			i = skipBlockComment(sql, i)
+		case c == '(':
+			depth++
+			i++
+		case c == ')':
+			depth--
+			i++
+		case c == ';' && depth == 0:
+			keywords = append(keywords, keyword{word: ";", start: i, end: i + 1})
+			i++
+		case isWordStart(c):
+			start := i
+			for i < len(sql) && isWordChar(sql[i]) {
+				i++
+			}
+
+			if depth == 0 && (start == 0 || !strings.ContainsRune(":.@", rune(sql[start-1]))) {
+				keywords = append(keywords, keyword{word: strings.ToUpper(sql[start:i]), start: start, end: i})
+			}
+		default:
+			i++
+		}
+	}
+
+	return keywords
+}
+
+// CheckBalanced verifies the parentheses, quotes, dollar quotes and block
+// comments of the ordinal query are balanced. It is a cheap sanity check
+// catching truncated queries, not a SQL parser
+func (q *Query) CheckBalanced() error {
+	sql := q.body()
+
+	var opened []int
+	for i := 0; i < len(sql); {
+		c := sql[i]
+
+		switch {
+		case c == '\'' || c == '"':
+			if !closesQuote(sql[i:], c) {
+				return fmt.Errorf("Query '%s' has unterminated %c quote at offset %d", q.Name, c, i)
+			}
+			i = skipQuoted(sql, i, c)
+		case c == '$':
+			tag, ok := dollarTag(sql[i:])
+			if !ok {
+				i++
+				continue
+			}
+			if !strings.Contains(sql[i+len(tag):], tag) {
+				return fmt.Errorf("Query '%s' has unterminated dollar quote %s at offset %d", q.Name, tag, i)
+			}
+			i = skipDollarQuoted(sql, i)
+		case strings.HasPrefix(sql[i:], "--"):
+			i = skipLineComment(sql, i)
+		case strings.HasPrefix(sql[i:], "/*"):
+			if !strings.Contains(sql[i+2:], "*/") {
+				return fmt.Errorf("Query '%s' has unterminated block comment at offset %d", q.Name, i)
+			}
+			i = skipBlockComment(sql, i)
+		case c == '(':
+			opened = append(opened, i)
+			i++
+		case c == ')':
+			if len(opened) == 0 {
+				return fmt.Errorf("Query '%s' has unmatched ) at offset %d", q.Name, i)
+			}
+			opened = opened[:len(opened)-1]
+			i++
+		default:
+			i++
+		}
+	}
+
+	if len(opened) > 0 {
+		return fmt.Errorf("Query '%s' has unclosed ( at offset %d", q.Name, opened[len(opened)-1])
+	}
+
+	return nil
+}
+
+// Validate scans the ordinal query for :name tokens left behind by the
+// rewrite, outside of literals, comments and :: casts, e.g. parameters not
+// matched by a custom parameter pattern. Reserved names and names escaped
+// as \:name are ignored
+func (q *Query) Validate() error {
+	var (
+		sql      = q.body()
+		opts     = q.options()
+		escaped  = make(map[string]bool)
+		dangling []string
+	)
+
+	for _, at := range colonEscapes(q.Raw) {
+		end := at + 2
+		for end < len(q.Raw) && (isWordChar(q.Raw[end]) || q.Raw[end] == '@') {
+			end++
+		}
+		escaped[q.Raw[at+2:end]] = true
+	}
+
+	for i := 0; i < len(sql); {
+		c := sql[i]
+
+		switch {
+		case c == '\'' || c == '"':
+			i = skipQuoted(sql, i, c)
+		case c == '$':
+			i = skipDollarQuoted(sql, i)
+		case strings.HasPrefix(sql[i:], "--"):
+			i = skipLineComment(sql, i)
+		case strings.HasPrefix(sql[i:], "/*"):
+			i = skipBlockComment(sql, i)
+		case strings.HasPrefix(sql[i:], "::"):
+			i += 2
+		case c == ':':
+			i++
+
+			start := i
+			if i < len(sql) && sql[i] == '@' {
+				i++
+			}
+			if i == len(sql) || !isWordStart(sql[i]) {
+				continue
+			}
+			for i < len(sql) && isWordChar(sql[i]) {
+				i++
+			}
+
+			if name := sql[start:i]; !opts.isReservedName(name) && !escaped[name] {
+				dangling = append(dangling, ":"+name)
+			}
+		default:
+			i++
+		}
+	}
+
+	if len(dangling) > 0 {
+		return fmt.Errorf("Query '%s' has unreplaced parameters %s", q.Name, strings.Join(dangling, ", "))
+	}
+
+	return nil
+}
+
+// closesQuote reports whether the literal starting at s[0] is terminated,
+// taking doubled quotes into account
+func closesQuote(s string, quote byte) bool {
+	for i := 1; i < len(s); i++ {
+		if s[i] != quote {
+			continue
+		}
+		if i+1 < len(s) && s[i+1] == quote {
+			i++
+			continue
+		}
+
+		return true
+	}
+
+	return false
+}
+
+// positionalMarks counts the bare ? placeholders outside of literals and
+// comments. Question marks followed by an operand (as in the jsonb
+// `data ? 'key'` operator) or forming the ?| and ?& operators are not counted
+func positionalMarks(sql string) int {
+	var count int
+
+	for i := 0; i < len(sql); {
+		c := sql[i]
+
+		switch {
+		case c == '\'' || c == '"':
+			i = skipQuoted(sql, i, c)
+		case c == '$':
+			i = skipDollarQuoted(sql, i)
+		case strings.HasPrefix(sql[i:], "--"):
+			i = skipLineComment(sql, i)
+		case strings.HasPrefix(sql[i:], "/*"):
+			i = skipBlockComment(sql, i)
+		case c == '?':
+			i++
+
+			next := strings.TrimLeft(sql[i:], " \t\r\n")
+			if next == "" || !strings.ContainsRune("'\":$|&", rune(next[0])) {
+				count++
+			}
+		default:
+			i++
+		}
+	}
+
+	return count
+}
+
+// numberedPlaceholders returns the placeholders made of prefix and a number,
+// e.g. $1, found outside of literals and comments
+func numberedPlaceholders(sql, prefix string) []string {
+	var placeholders []string
+
+	for i := 0; i < len(sql); {
+		c := sql[i]
+
+		switch {
+		case strings.HasPrefix(sql[i:], prefix) && i+len(prefix) < len(sql) && isDigit(sql[i+len(prefix)]):
+			start := i
+			i += len(prefix)
+			for i < len(sql) && isDigit(sql[i]) {
+				i++
+			}
+			placeholders = append(placeholders, sql[start:i])
+		case c == '\'' || c == '"':
+			i = skipQuoted(sql, i, c)
+		case c == '$':
+			i = skipDollarQuoted(sql, i)
+		case strings.HasPrefix(sql[i:], "--"):
+			i = skipLineComment(sql, i)
+		case strings.HasPrefix(sql[i:], "/*"):
+			i = skipBlockComment(sql, i)
+		default:
+			i++
+		}
+	}
+
+	return placeholders
+}
+
+// colonEscapes returns the positions of the backslashes escaping a colon,
+// as in `\:notaparam`, outside of literals and comments
+func colonEscapes(sql string) []int {
+	var escapes []int
+
+	for i := 0; i < len(sql); {
+		c := sql[i]
+
+		switch {
+		case c == '\'' || c == '"':
+			i = skipQuoted(sql, i, c)
+		case c == '$':
+			i = skipDollarQuoted(sql, i)
+		case strings.HasPrefix(sql[i:], "--"):
+			i = skipLineComment(sql, i)
+		case strings.HasPrefix(sql[i:], "/*"):
+			i = skipBlockComment(sql, i)
+		case strings.HasPrefix(sql[i:], "\\:"):
+			escapes = append(escapes, i)
+			i += 2
+		default:
+			i++
+		}
+	}
+
+	return escapes
+}
+
+// unescapeColons drops the backslashes of escaped colons, turning
+// `\:notaparam` into the literal `:notaparam`
+func unescapeColons(sql string) string {
+	escapes := colonEscapes(sql)
+	if len(escapes) == 0 {
+		return sql
+	}
+
+	var (
+		b    strings.Builder
+		last int
+	)
+	for _, at := range escapes {
+		b.WriteString(sql[last:at])
+		last = at + 1
+	}
+	b.WriteString(sql[last:])
+
+	return b.String()
+}
+
+// skipQuoted returns the position after the literal or quoted identifier
+// starting at i. Doubled quotes are part of the literal
+func skipQuoted(sql string, i int, quote byte) int {
+	for i++; i < len(sql); i++ {
+		if sql[i] != quote {
+			continue
+		}
+		if i+1 < len(sql) && sql[i+1] == quote {
+			i++
+			continue
+		}
+
+		return i + 1
+	}
+
+	return len(sql)
+}
+
+// skipDollarQuoted returns the position after the dollar quoted string
+// starting at i, or the next position when i does not start one
+func skipDollarQuoted(sql string, i int) int {
+	tag, ok := dollarTag(sql[i:])
+	if !ok {
+		return i + 1
+	}
+
+	end := strings.Index(sql[i+len(tag):], tag)
+	if end < 0 {
+		return len(sql)
+	}
+
+	return i + len(tag) + end + len(tag)
+}
+
+// dollarTag returns the opening tag ($$ or $tag$) at the start of s
+func dollarTag(s string) (string, bool) {
+	if len(s) < 2 || s[0] != '$' {
+		return "", false
+	}
+
+	for i := 1; i < len(s); i++ {
+		switch {
+		case s[i] == '$':
+			return s[:i+1], true
+		case i == 1 && !isWordStart(s[i]), !isWordChar(s[i]):
+			return "", false
+		}
+	}
+
+	return "", false
+}
+
+func skipLineComment(sql string, i int) int {
+	end := strings.IndexByte(sql[i:], '\n')
+	if end < 0 {
+		return len(sql)
+	}
+
+	return i + end + 1
+}
+
+func skipBlockComment(sql string, i int) int {
+	end := strings.Index(sql[i+2:], "*/")
+	if end < 0 {
+		return len(sql)
+	}
+
+	return i + 2 + end + 2
+}
+
+func isWordStart(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isWordChar(c byte) bool {
+	return isWordStart(c) || isDigit(c)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
@@ -0,0 +1,251 @@
+package queries
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestWhereClause(t *testing.T) {
+	testCases := []struct {
+		name     string
+		query    string
+		expected string
+		found    bool
+	}{
+		{
+			name:     "simple",
+			query:    "SELECT * FROM users WHERE id = :id",
+			expected: "WHERE id = :id",
+			found:    true,
+		},
+		{
+			name:     "terminated",
+			query:    "SELECT * FROM users u\nJOIN orders o ON o.user_id = u.id\nWHERE u.tenant_id = :tenant_id AND o.total > :total\nORDER BY u.name\nLIMIT :limit",
+			expected: "WHERE u.tenant_id = :tenant_id AND o.total > :total",
+			found:    true,
+		},
+		{
+			name:     "subquery",
+			query:    "SELECT * FROM (SELECT * FROM users WHERE active) u WHERE u.name = 'a where b' GROUP BY 1",
+			expected: "WHERE u.name = 'a where b'",
+			found:    true,
+		},
+		{
+			name:  "without-where",
+			query: "SELECT * FROM users ORDER BY name LIMIT :limit",
+		},
+		{
+			name:  "only-in-subquery",
+			query: "SELECT * FROM (SELECT * FROM users WHERE id = :id) u -- WHERE in a comment",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			where, found := NewQuery(tc.name, tc.query).WhereClause()
+			if where != tc.expected || found != tc.found {
+				t.Errorf("WhereClause() = %q, %v; expected %q, %v", where, found, tc.expected, tc.found)
+			}
+		})
+	}
+}
+
+func TestCountQuery(t *testing.T) {
+	testCases := []struct {
+		name        string
+		query       string
+		expectedRaw string
+		expectedMap map[string]int
+	}{
+		{
+			name:        "joins",
+			query:       "SELECT u.id, u.name, o.total\nFROM users u\nJOIN orders o ON o.user_id = u.id\nWHERE u.tenant_id = :tenant_id AND o.total > :total\nORDER BY u.name\nLIMIT :limit OFFSET :offset",
+			expectedRaw: "SELECT count(*) FROM users u\nJOIN orders o ON o.user_id = u.id\nWHERE u.tenant_id = :tenant_id AND o.total > :total",
+			expectedMap: map[string]int{"tenant_id": 1, "total": 2},
+		},
+		{
+			name:        "cte",
+			query:       "WITH active AS (SELECT * FROM users WHERE active ORDER BY id) SELECT * FROM active WHERE name LIKE :name",
+			expectedRaw: "WITH active AS (SELECT * FROM users WHERE active ORDER BY id) SELECT count(*) FROM active WHERE name LIKE :name",
+			expectedMap: map[string]int{"name": 1},
+		},
+		{
+			name:        "grouped",
+			query:       "SELECT tenant_id, count(*) FROM users WHERE created_at > :since GROUP BY tenant_id ORDER BY 2 DESC",
+			expectedRaw: "SELECT count(*) FROM (SELECT tenant_id, count(*) FROM users WHERE created_at > :since GROUP BY tenant_id) AS counted",
+			expectedMap: map[string]int{"since": 1},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			count, err := NewQuery(tc.name, tc.query).CountQuery()
+			if err != nil {
+				t.Fatalf("CountQuery: unexpected error %v", err)
+			}
+			if count.Raw != tc.expectedRaw {
+				t.Errorf("Raw: got %q, expected %q", count.Raw, tc.expectedRaw)
+			}
+			if count.Name != tc.name+"-count" {
+				t.Errorf("Name: got %s", count.Name)
+			}
+			if !reflect.DeepEqual(count.Mapping, tc.expectedMap) {
+				t.Errorf("Mapping: got %v, expected %v", count.Mapping, tc.expectedMap)
+			}
+		})
+	}
+
+	store := NewQueryStore()
+	if err := store.loadQueriesFromFile("users.sql", strings.NewReader("-- name: list\n-- style: question\nSELECT * FROM users WHERE status = :status AND org = :org LIMIT 10")); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	count, err := store.MustHaveQuery("list").CountQuery()
+	if err != nil {
+		t.Fatalf("CountQuery: unexpected error %v", err)
+	}
+	if expected := "-- list-count\nSELECT count(*) FROM users WHERE status = ? AND org = ?"; count.OrdinalQuery != expected {
+		t.Errorf("OrdinalQuery: got %q, expected %q", count.OrdinalQuery, expected)
+	}
+
+	// the count query binds the declared defaults like the query it counts
+	if err := store.loadQueriesFromFile("orders.sql", strings.NewReader("-- name: list-orders\n-- default status: 'active'\nSELECT * FROM orders WHERE status = :status AND org = :org LIMIT 10")); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	list := store.MustHaveQuery("list-orders")
+	count, err = list.CountQuery()
+	if err != nil {
+		t.Fatalf("CountQuery: unexpected error %v", err)
+	}
+	args := map[string]interface{}{"org": 1}
+	if prepared, counted := list.Prepare(args), count.Prepare(args); !reflect.DeepEqual(prepared, counted) {
+		t.Errorf("count query prepared %v, expected %v", counted, prepared)
+	}
+	if count.Source != "orders.sql" {
+		t.Errorf("Source: got %q", count.Source)
+	}
+
+	for _, query := range []string{"UPDATE users SET name = :name", "SELECT 1"} {
+		if _, err := NewQuery("invalid", query).CountQuery(); err == nil {
+			t.Errorf("CountQuery(%q): expected error", query)
+		}
+	}
+}
+
+func TestCheckBalanced(t *testing.T) {
+	testCases := []struct {
+		name        string
+		query       string
+		expectedErr string
+	}{
+		{name: "balanced", query: "SELECT count(*) FROM users WHERE (id = :id OR name = 'it''s (') AND body = $$ ) $$ -- )"},
+		{name: "nested", query: "SELECT * FROM (SELECT id FROM (SELECT 1 AS id) a) b"},
+		{name: "quoted-identifier", query: `SELECT "weird(" FROM users`},
+		{name: "unclosed-paren", query: "SELECT * FROM users WHERE id IN (:ids", expectedErr: "unclosed ( at offset 32"},
+		{name: "extra-paren", query: "SELECT * FROM users WHERE id = :id)", expectedErr: "unmatched ) at offset 33"},
+		{name: "unterminated-quote", query: "SELECT * FROM users WHERE name = 'john", expectedErr: "unterminated ' quote"},
+		{name: "unterminated-doubled-quote", query: "SELECT * FROM users WHERE name = 'john''", expectedErr: "unterminated ' quote"},
+		{name: "unterminated-dollar", query: "SELECT $body$ unterminated", expectedErr: "unterminated dollar quote $body$"},
+		{name: "unterminated-comment", query: "SELECT 1 /* never closed", expectedErr: "unterminated block comment"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := NewQuery(tc.name, tc.query).CheckBalanced()
+			if tc.expectedErr == "" {
+				if err != nil {
+					t.Errorf("unexpected error %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.expectedErr) {
+				t.Errorf("expected error containing %q, got %v", tc.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	testCases := []struct {
+		name        string
+		query       string
+		opts        []Option
+		expectedErr string
+	}{
+		{name: "compiled", query: "SELECT * FROM users WHERE id = :id AND created::date = :day"},
+		{name: "literals", query: "SELECT ':a', \":b\", $$ :c $$ FROM t WHERE x = :x -- :d\n/* :e */"},
+		{name: "reserved", query: "SELECT to_char(ts, 'x'), to_char(ts, HH24:MI:SS) FROM t"},
+		{name: "oracle", query: "SELECT * FROM users WHERE id = :id", opts: []Option{WithDialect(Oracle)}},
+		{name: "unknown-auto", query: "SELECT * FROM t WHERE ts < :@yesterday", expectedErr: "unreplaced parameters :@yesterday"},
+		{
+			name:        "pattern-miss",
+			query:       "SELECT * FROM users WHERE id = :id AND name = :Name",
+			opts:        []Option{WithParamPattern("[a-z][a-z0-9_]*")},
+			expectedErr: "unreplaced parameters :Name",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := NewQuery(tc.name, tc.query, tc.opts...).Validate()
+			if tc.expectedErr == "" {
+				if err != nil {
+					t.Errorf("unexpected error %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.expectedErr) {
+				t.Errorf("expected error containing %q, got %v", tc.expectedErr, err)
+			}
+		})
+	}
+
+	store := NewQueryStore(WithValidation(), WithParamPattern("[a-z][a-z0-9_]*"))
+	err := store.loadQueriesFromFile("v.sql", strings.NewReader("-- name: v\nSELECT * FROM users WHERE name = :Name"))
+	if err == nil || !strings.Contains(err.Error(), "Query 'v' has unreplaced parameters :Name") {
+		t.Errorf("expected the load to fail, got %v", err)
+	}
+}
+
+func TestStatements(t *testing.T) {
+	q := NewQuery("transfer", `UPDATE accounts SET balance = balance - :amount WHERE id = :from;
+UPDATE accounts SET balance = balance + :amount, note = 'moved; done' WHERE id = :to;
+`)
+
+	expected := []string{
+		"UPDATE accounts SET balance = balance - $1 WHERE id = $2",
+		"UPDATE accounts SET balance = balance + $1, note = 'moved; done' WHERE id = $3",
+	}
+	if statements := q.Statements(); !reflect.DeepEqual(statements, expected) {
+		t.Errorf("Statements: expected %q, got %q", expected, statements)
+	}
+
+	split := q.SplitStatements()
+	if len(split) != 2 {
+		t.Fatalf("expected 2 statements, got %d", len(split))
+	}
+
+	if split[0].Name != "transfer-1" || split[1].Name != "transfer-2" {
+		t.Errorf("unexpected names %s, %s", split[0].Name, split[1].Name)
+	}
+	if expected := "UPDATE accounts SET balance = balance + $1, note = 'moved; done' WHERE id = $2"; split[1].body() != expected {
+		t.Errorf("expected %q, got %q", expected, split[1].body())
+	}
+
+	args := map[string]interface{}{"amount": 10, "from": 1, "to": 2}
+	if prepared := split[1].Prepare(args); !reflect.DeepEqual(prepared, []interface{}{10, 2}) {
+		t.Errorf("unexpected arguments %v", prepared)
+	}
+
+	store := NewQueryStore()
+	if err := store.loadQueriesFromFile("accounts.sql", strings.NewReader("-- name: transfer\n-- style: question\n"+q.Raw)); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	split = store.MustHaveQuery("transfer").SplitStatements()
+	if expected := "UPDATE accounts SET balance = balance + ?, note = 'moved; done' WHERE id = ?"; split[1].body() != expected {
+		t.Errorf("expected %q, got %q", expected, split[1].body())
+	}
+	if count := split[1].PlaceholderCount(); count != 2 {
+		t.Errorf("PlaceholderCount: expected 2, got %d", count)
+	}
+}
@@ -0,0 +1,112 @@
+package queries
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Dialect identifies the SQL database flavour
+type Dialect int
+
+const (
+	Postgres Dialect = iota
+	MySQL
+	SQLServer
+	SQLite
+	Oracle
+)
+
+func (d Dialect) String() string {
+	switch d {
+	case Postgres:
+		return "postgres"
+	case MySQL:
+		return "mysql"
+	case SQLServer:
+		return "sqlserver"
+	case SQLite:
+		return "sqlite"
+	case Oracle:
+		return "oracle"
+	}
+
+	return fmt.Sprintf("Dialect(%d)", int(d))
+}
+
+// identifierQuotes returns the opening and closing identifier quote of the
+// dialect
+func (d Dialect) identifierQuotes() (string, string, error) {
+	switch d {
+	case Postgres, SQLite, Oracle:
+		return `"`, `"`, nil
+	case MySQL:
+		return "`", "`", nil
+	case SQLServer:
+		return "[", "]", nil
+	}
+
+	return "", "", fmt.Errorf("Unsupported dialect %s", d)
+}
+
+// placeholder returns the bind placeholder of the dialect for the ordinal
+func (d Dialect) placeholder(ord int) string {
+	switch d {
+	case MySQL, SQLite:
+		return "?"
+	case SQLServer:
+		return fmt.Sprintf("@p%d", ord)
+	case Oracle:
+		return fmt.Sprintf(":%d", ord)
+	}
+
+	return fmt.Sprintf("$%d", ord)
+}
+
+// questionMarks reports whether the dialect binds with ? placeholders, which
+// cannot be reused and need an argument for every occurrence
+func (d Dialect) questionMarks() bool {
+	return d == MySQL || d == SQLite
+}
+
+// ordinalPrefix returns the prefix of the numbered placeholders of the
+// dialect
+func (d Dialect) ordinalPrefix() string {
+	switch d {
+	case SQLServer:
+		return "@p"
+	case Oracle:
+		return ":"
+	}
+
+	return "$"
+}
+
+// QuoteIdentifier quotes a table or column name for safe use in dynamically
+// built SQL. An identifier containing the closing quote character is rejected
+// unless the character is already doubled
+func QuoteIdentifier(dialect Dialect, ident string) (string, error) {
+	open, closing, err := dialect.identifierQuotes()
+	if err != nil {
+		return "", err
+	}
+
+	if len(ident) == 0 {
+		return "", fmt.Errorf("Empty identifier")
+	}
+	if strings.ContainsRune(ident, 0) {
+		return "", fmt.Errorf("Identifier %q contains a NUL character", ident)
+	}
+
+	for rest := ident; len(rest) > 0; {
+		i := strings.Index(rest, closing)
+		if i < 0 {
+			break
+		}
+		if !strings.HasPrefix(rest[i+1:], closing) {
+			return "", fmt.Errorf("Identifier %q contains unescaped %s", ident, closing)
+		}
+		rest = rest[i+2:]
+	}
+
+	return open + ident + closing, nil
+}
@@ -0,0 +1,148 @@
+package queries
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestQuoteIdentifier(t *testing.T) {
+	testCases := []struct {
+		name        string
+		dialect     Dialect
+		ident       string
+		expected    string
+		expectedErr bool
+	}{
+		{name: "postgres", dialect: Postgres, ident: "users", expected: `"users"`},
+		{name: "postgres-doubled", dialect: Postgres, ident: `my""table`, expected: `"my""table"`},
+		{name: "postgres-injection", dialect: Postgres, ident: `users"; DROP TABLE users; --`, expectedErr: true},
+		{name: "postgres-backtick", dialect: Postgres, ident: "a`b", expected: "\"a`b\""},
+		{name: "mysql", dialect: MySQL, ident: "order", expected: "`order`"},
+		{name: "mysql-doubled", dialect: MySQL, ident: "a``b", expected: "`a``b`"},
+		{name: "mysql-injection", dialect: MySQL, ident: "users`; DROP TABLE users; --", expectedErr: true},
+		{name: "sqlserver", dialect: SQLServer, ident: "user name", expected: "[user name]"},
+		{name: "sqlserver-doubled", dialect: SQLServer, ident: "a]]b", expected: "[a]]b]"},
+		{name: "sqlserver-injection", dialect: SQLServer, ident: "users]; DROP TABLE users; --", expectedErr: true},
+		{name: "empty", dialect: Postgres, ident: "", expectedErr: true},
+		{name: "nul", dialect: Postgres, ident: "a\x00b", expectedErr: true},
+		{name: "unknown-dialect", dialect: Dialect(42), ident: "users", expectedErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			quoted, err := QuoteIdentifier(tc.dialect, tc.ident)
+			if tc.expectedErr {
+				if err == nil {
+					t.Errorf("QuoteIdentifier(%s, %q) = %s; expected error", tc.dialect, tc.ident, quoted)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("QuoteIdentifier(%s, %q): unexpected error %v", tc.dialect, tc.ident, err)
+			}
+			if quoted != tc.expected {
+				t.Errorf("QuoteIdentifier(%s, %q) = %s; expected %s", tc.dialect, tc.ident, quoted, tc.expected)
+			}
+		})
+	}
+}
+
+func TestWithDialect(t *testing.T) {
+	sql := "SELECT * FROM users WHERE id = :id OR parent_id = :id AND status = :status"
+	args := map[string]interface{}{"id": 7, "status": "active"}
+
+	testCases := []struct {
+		name         string
+		opts         []Option
+		expected     string
+		expectedArgs []interface{}
+	}{
+		{
+			name:         "default",
+			expected:     "SELECT * FROM users WHERE id = $1 OR parent_id = $1 AND status = $2",
+			expectedArgs: []interface{}{7, "active"},
+		},
+		{
+			name:         "postgres",
+			opts:         []Option{WithDialect(Postgres)},
+			expected:     "SELECT * FROM users WHERE id = $1 OR parent_id = $1 AND status = $2",
+			expectedArgs: []interface{}{7, "active"},
+		},
+		{
+			name:         "mysql",
+			opts:         []Option{WithDialect(MySQL)},
+			expected:     "SELECT * FROM users WHERE id = ? OR parent_id = ? AND status = ?",
+			expectedArgs: []interface{}{7, 7, "active"},
+		},
+		{
+			name:         "sqlite",
+			opts:         []Option{WithDialect(SQLite)},
+			expected:     "SELECT * FROM users WHERE id = ? OR parent_id = ? AND status = ?",
+			expectedArgs: []interface{}{7, 7, "active"},
+		},
+		{
+			name:         "sqlserver",
+			opts:         []Option{WithDialect(SQLServer)},
+			expected:     "SELECT * FROM users WHERE id = @p1 OR parent_id = @p1 AND status = @p2",
+			expectedArgs: []interface{}{7, "active"},
+		},
+		{
+			name:         "oracle",
+			opts:         []Option{WithDialect(Oracle)},
+			expected:     "SELECT * FROM users WHERE id = :1 OR parent_id = :1 AND status = :2",
+			expectedArgs: []interface{}{7, "active"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			q := NewQuery("find-user", sql, append(tc.opts, WithDebugChecks())...)
+
+			if q.Query() != "-- find-user\n"+tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, q.Query())
+			}
+			if prepared := q.Prepare(args); !reflect.DeepEqual(prepared, tc.expectedArgs) {
+				t.Errorf("expected arguments %v, got %v", tc.expectedArgs, prepared)
+			}
+		})
+	}
+}
+
+func TestDialectStrayOrdinals(t *testing.T) {
+	testCases := []struct {
+		name    string
+		dialect Dialect
+		query   string
+		stray   string
+	}{
+		{name: "oracle", dialect: Oracle, query: "SELECT * FROM t WHERE a = :1 AND id = :id", stray: ":1"},
+		{name: "sqlserver", dialect: SQLServer, query: "SELECT * FROM t WHERE a = @p1 AND id = :id", stray: "@p1"},
+		{name: "oracle-literal", dialect: Oracle, query: "SELECT * FROM t WHERE at = '10:30:00' AND id = :id"},
+		{name: "sqlserver-literal", dialect: SQLServer, query: "SELECT * FROM t WHERE note = '@p2' AND id = :id"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := NewQueryStore(WithDialect(tc.dialect), WithDebugChecks())
+			err := store.loadQueriesFromFile(tc.name+".sql", strings.NewReader(tc.query))
+			if tc.stray != "" {
+				if err == nil || !strings.Contains(err.Error(), "positional placeholders "+tc.stray) {
+					t.Errorf("expected error naming %s, got %v", tc.stray, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+
+			q := store.MustHaveQuery(tc.name)
+			if count := q.PlaceholderCount(); count != 1 {
+				t.Errorf("PlaceholderCount() = %d; expected 1", count)
+			}
+			if prepared := q.Prepare(map[string]interface{}{"id": 1}); !reflect.DeepEqual(prepared, []interface{}{1}) {
+				t.Errorf("unexpected arguments %v", prepared)
+			}
+		})
+	}
+}
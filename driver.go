@@ -0,0 +1,77 @@
+package queries
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// Exec prepares the arguments and executes the query on db. Queries marked
+// with `-- tx: true` run inside a transaction which is committed on success
+// and rolled back on error
+func (q *Query) Exec(ctx context.Context, db *sql.DB, args map[string]interface{}) (sql.Result, error) {
+	if !q.InTransaction {
+		return db.ExecContext(ctx, q.Query(), q.Prepare(args)...)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Query '%s': %v", q.Name, err)
+	}
+
+	result, err := tx.ExecContext(ctx, q.Query(), q.Prepare(args)...)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("Query '%s': %v", q.Name, err)
+	}
+
+	return result, nil
+}
+
+// NamedQuery returns the query with the named parameters written as @name
+// markers, for drivers binding database/sql named arguments (e.g. SQL Server)
+func (q *Query) NamedQuery() string {
+	c := q.translate(func(placeholder, name string) string {
+		return "@" + namedArg(name)
+	})
+
+	return fmt.Sprintf("-- %s\n%s", q.Name, c.sql)
+}
+
+// PrepareNamed prepares the arguments of NamedQuery as sql.Named values, one
+// per parameter in ordinal order. Each value is named after the parameter,
+// so :user_id in the query is bound by sql.Named("user_id", args["user_id"])
+func (q *Query) PrepareNamed(args map[string]interface{}) []interface{} {
+	var (
+		get   = mapArgs(q.normalizeArgs(args))
+		named []interface{}
+		seen  = make(map[string]bool)
+	)
+
+	for _, name := range q.slotParams() {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		value, _ := q.lookupArgument(get, name)
+		if q.options().derefPointers {
+			value = derefPointer(value)
+		}
+
+		named = append(named, sql.Named(namedArg(name), value))
+	}
+
+	return named
+}
+
+// namedArg returns the name of the argument binding the parameter. The
+// leading @ of automatic parameters is dropped
+func namedArg(name string) string {
+	return strings.TrimPrefix(name, "@")
+}
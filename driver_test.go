@@ -0,0 +1,176 @@
+package queries
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordingDriver logs the statements and transaction boundaries it sees
+type recordingDriver struct {
+	mu      sync.Mutex
+	log     []string
+	failing string
+}
+
+func (d *recordingDriver) record(entry string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.log = append(d.log, entry)
+}
+
+func (d *recordingDriver) Open(name string) (driver.Conn, error) {
+	return &recordingConn{driver: d}, nil
+}
+
+type recordingConn struct {
+	driver *recordingDriver
+}
+
+func (c *recordingConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("not supported")
+}
+
+func (c *recordingConn) Close() error {
+	return nil
+}
+
+func (c *recordingConn) Begin() (driver.Tx, error) {
+	c.driver.record("BEGIN")
+	return c, nil
+}
+
+func (c *recordingConn) Commit() error {
+	c.driver.record("COMMIT")
+	return nil
+}
+
+func (c *recordingConn) Rollback() error {
+	c.driver.record("ROLLBACK")
+	return nil
+}
+
+func (c *recordingConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.driver.record(query)
+	if c.driver.failing != "" && strings.Contains(query, c.driver.failing) {
+		return nil, errors.New("exec failed")
+	}
+
+	return driver.RowsAffected(1), nil
+}
+
+func openRecording(t *testing.T) (*sql.DB, *recordingDriver) {
+	d := &recordingDriver{}
+	db := sql.OpenDB(recordingConnector{d})
+	t.Cleanup(func() { db.Close() })
+
+	return db, d
+}
+
+type recordingConnector struct {
+	driver *recordingDriver
+}
+
+func (c recordingConnector) Connect(context.Context) (driver.Conn, error) {
+	return c.driver.Open("")
+}
+
+func (c recordingConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+func TestTransactionMetadata(t *testing.T) {
+	input := `-- name: transfer
+-- tx: true
+UPDATE accounts SET balance = balance - :amount WHERE id = :id
+
+-- name: touch
+SELECT 1`
+
+	store := NewQueryStore()
+	if err := store.loadQueriesFromFile("accounts.sql", strings.NewReader(input)); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if !store.MustHaveQuery("transfer").InTransaction {
+		t.Error("expected transfer to run in a transaction")
+	}
+	if store.MustHaveQuery("touch").InTransaction {
+		t.Error("expected touch not to run in a transaction")
+	}
+
+	err := store.loadQueriesFromFile("bad.sql", strings.NewReader("-- name: bad\n-- tx: maybe\nSELECT 1"))
+	if err == nil || !strings.Contains(err.Error(), "invalid tx metadata 'maybe'") {
+		t.Errorf("expected invalid tx error, got %v", err)
+	}
+}
+
+func TestExec(t *testing.T) {
+	input := `-- name: transfer
+-- tx: true
+UPDATE accounts SET balance = balance - :amount WHERE id = :id
+
+-- name: touch
+UPDATE accounts SET touched_at = now() WHERE id = :id`
+
+	store := NewQueryStore()
+	if err := store.loadQueriesFromFile("accounts.sql", strings.NewReader(input)); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	ctx := context.Background()
+	args := map[string]interface{}{"id": 1, "amount": 10}
+
+	db, d := openRecording(t)
+	if _, err := store.MustHaveQuery("transfer").Exec(ctx, db, args); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	expected := []string{"BEGIN", store.MustHaveQuery("transfer").Query(), "COMMIT"}
+	if !reflect.DeepEqual(d.log, expected) {
+		t.Errorf("got %v, expected %v", d.log, expected)
+	}
+
+	db, d = openRecording(t)
+	if _, err := store.MustHaveQuery("touch").Exec(ctx, db, args); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	expected = []string{store.MustHaveQuery("touch").Query()}
+	if !reflect.DeepEqual(d.log, expected) {
+		t.Errorf("got %v, expected %v", d.log, expected)
+	}
+
+	db, d = openRecording(t)
+	d.failing = "balance"
+	if _, err := store.MustHaveQuery("transfer").Exec(ctx, db, args); err == nil {
+		t.Fatal("expected exec error")
+	}
+	expected = []string{"BEGIN", store.MustHaveQuery("transfer").Query(), "ROLLBACK"}
+	if !reflect.DeepEqual(d.log, expected) {
+		t.Errorf("got %v, expected %v", d.log, expected)
+	}
+}
+
+func TestPrepareNamed(t *testing.T) {
+	q := NewQuery("find-user", "SELECT * FROM users WHERE id = :user_id OR parent_id = :user_id AND created_at < :@now AND status = :status")
+
+	expected := "-- find-user\nSELECT * FROM users WHERE id = @user_id OR parent_id = @user_id AND created_at < @now AND status = @status"
+	if named := q.NamedQuery(); named != expected {
+		t.Errorf("expected %q, got %q", expected, named)
+	}
+
+	args := q.PrepareNamed(map[string]interface{}{"user_id": 7, "status": "active"})
+	if len(args) != 3 {
+		t.Fatalf("expected 3 named arguments, got %v", args)
+	}
+	if args[0] != sql.Named("user_id", 7) || args[2] != sql.Named("status", "active") {
+		t.Errorf("unexpected named arguments %v", args)
+	}
+	if now, ok := args[1].(sql.NamedArg); !ok || now.Name != "now" {
+		t.Errorf("expected generated now argument, got %v", args[1])
+	}
+}
@@ -0,0 +1,315 @@
+package queries
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Warning describes a potential problem found by Lint
+type Warning struct {
+	Query   string
+	Message string
+}
+
+func (w Warning) String() string {
+	return fmt.Sprintf("%s: %s", w.Query, w.Message)
+}
+
+type lintCheck func(q *Query) []Warning
+
+var (
+	lintChecks = []lintCheck{
+		lintAdjacentParams,
+		lintKeywordParams,
+		lintCartesianJoin,
+		lintNormalizedParams,
+	}
+
+	// joinPredicateRE matches equalities of qualified columns, a.id = b.a_id
+	joinPredicateRE = regexp.MustCompile(`([A-Za-z_][A-Za-z0-9_]*)\.[A-Za-z_][A-Za-z0-9_]*\s*=\s*([A-Za-z_][A-Za-z0-9_]*)\.[A-Za-z_][A-Za-z0-9_]*`)
+
+	sqlKeywords = map[string]bool{
+		"ALL": true, "ALTER": true, "AND": true, "ANY": true, "AS": true, "ASC": true,
+		"BETWEEN": true, "BY": true, "CASE": true, "CHECK": true, "COLUMN": true,
+		"CREATE": true, "CROSS": true, "DEFAULT": true, "DELETE": true, "DESC": true,
+		"DISTINCT": true, "DROP": true, "ELSE": true, "END": true, "EXISTS": true,
+		"FALSE": true, "FETCH": true, "FOR": true, "FOREIGN": true, "FROM": true,
+		"FULL": true, "GRANT": true, "GROUP": true, "HAVING": true, "IN": true,
+		"INNER": true, "INSERT": true, "INTO": true, "IS": true, "JOIN": true,
+		"KEY": true, "LEFT": true, "LIKE": true, "LIMIT": true, "NOT": true,
+		"NULL": true, "OFFSET": true, "ON": true, "OR": true, "ORDER": true,
+		"OUTER": true, "PRIMARY": true, "REFERENCES": true, "RETURNING": true,
+		"RIGHT": true, "SELECT": true, "SET": true, "TABLE": true, "THEN": true,
+		"TO": true, "TRUE": true, "UNION": true, "UNIQUE": true, "UPDATE": true,
+		"USER": true, "USING": true, "VALUES": true, "WHEN": true, "WHERE": true,
+		"WITH": true,
+	}
+)
+
+// Lint runs advisory checks over the query. Warnings do not prevent the
+// query from being used
+func (q *Query) Lint() []Warning {
+	var warnings []Warning
+	for _, check := range lintChecks {
+		warnings = append(warnings, check(q)...)
+	}
+
+	return warnings
+}
+
+// Lint runs advisory checks over all queries in the store, ordered by query
+// name, followed by checks comparing the queries with each other
+func (s *QueryStore) Lint() []Warning {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var warnings []Warning
+	for _, name := range s.names() {
+		warnings = append(warnings, s.queries[name].Lint()...)
+	}
+
+	return append(warnings, s.lintSwappedParams()...)
+}
+
+// lintSwappedParams flags queries compiling to the same SQL with the same
+// parameters bound in a different order, a sign of copy-paste with swapped
+// bindings. The caller holds the lock
+func (s *QueryStore) lintSwappedParams() []Warning {
+	var (
+		warnings []Warning
+		seen     = make(map[string]*Query)
+	)
+
+	for _, name := range s.names() {
+		q := s.queries[name]
+		if len(q.Mapping) < 2 {
+			continue
+		}
+
+		other, ok := seen[q.body()]
+		if !ok {
+			seen[q.body()] = q
+			continue
+		}
+
+		if sameParamSet(q, other) && strings.Join(q.params, ",") != strings.Join(other.params, ",") {
+			warnings = append(warnings, Warning{
+				Query: q.Name,
+				Message: fmt.Sprintf("Query differs from '%s' only in parameter order (%s vs %s)",
+					other.Name, strings.Join(q.params, ", "), strings.Join(other.params, ", ")),
+			})
+		}
+	}
+
+	return warnings
+}
+
+func sameParamSet(a, b *Query) bool {
+	if len(a.Mapping) != len(b.Mapping) {
+		return false
+	}
+
+	for name := range a.Mapping {
+		if _, ok := b.Mapping[name]; !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// lintAdjacentParams flags parameters glued to the preceding word, like
+// `LIMIT:limit`. Literals and comments are not checked
+func lintAdjacentParams(q *Query) []Warning {
+	var warnings []Warning
+
+	for _, p := range scanParams(q.Raw, q.options()) {
+		start := p.start
+		for start > 0 && isWordChar(q.Raw[start-1]) {
+			start--
+		}
+		if start == p.start {
+			continue
+		}
+
+		word := q.Raw[start:p.start]
+		warnings = append(warnings, Warning{
+			Query:   q.Name,
+			Message: fmt.Sprintf("Parameter '%s' directly follows '%s'; add a space before ':%s'", p.name, word, p.name),
+		})
+	}
+
+	return warnings
+}
+
+// lintKeywordParams flags parameters named like SQL keywords, e.g. `:order`
+func lintKeywordParams(q *Query) []Warning {
+	names := make([]string, 0, len(q.Mapping))
+	for name := range q.Mapping {
+		if sqlKeywords[strings.ToUpper(name)] {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return q.Mapping[names[i]] < q.Mapping[names[j]]
+	})
+
+	warnings := make([]Warning, 0, len(names))
+	for _, name := range names {
+		warnings = append(warnings, Warning{
+			Query:   q.Name,
+			Message: fmt.Sprintf("Parameter '%s' shadows the SQL keyword %s", name, strings.ToUpper(name)),
+		})
+	}
+
+	return warnings
+}
+
+// lintCartesianJoin flags comma separated tables in the top-level FROM clause
+// which are not linked by an equality of their qualified columns, a likely
+// Cartesian product. The check is approximate: it relies on table names or
+// aliases qualifying the join predicates and does not parse the SQL
+func lintCartesianJoin(q *Query) []Warning {
+	keywords := topLevelKeywords(q.Raw)
+
+	var from string
+	for i, kw := range keywords {
+		if kw.word != "FROM" {
+			continue
+		}
+
+		end := len(q.Raw)
+		for _, next := range keywords[i+1:] {
+			if next.word == "WHERE" || whereTerminators[next.word] {
+				end = next.start
+				break
+			}
+		}
+
+		from = q.Raw[kw.end:end]
+		break
+	}
+
+	items := splitOutsideParens(from)
+	if len(items) < 2 {
+		return nil
+	}
+
+	// tables linked by a predicate end up in the same group
+	groups := make(map[string]string)
+	var find func(alias string) string
+	find = func(alias string) string {
+		if groups[alias] == alias {
+			return alias
+		}
+		groups[alias] = find(groups[alias])
+		return groups[alias]
+	}
+
+	aliases := make([]string, 0, len(items))
+	for _, item := range items {
+		alias := fromAlias(item)
+		if alias == "" {
+			return nil
+		}
+		aliases = append(aliases, alias)
+		groups[alias] = alias
+	}
+
+	where, _ := q.WhereClause()
+	for _, match := range joinPredicateRE.FindAllStringSubmatch(from+" "+where, -1) {
+		a, b := strings.ToLower(match[1]), strings.ToLower(match[2])
+		if _, ok := groups[a]; !ok {
+			continue
+		}
+		if _, ok := groups[b]; !ok {
+			continue
+		}
+		groups[find(a)] = find(b)
+	}
+
+	distinct := make(map[string]bool)
+	for _, alias := range aliases {
+		distinct[find(alias)] = true
+	}
+	if len(distinct) < 2 {
+		return nil
+	}
+
+	return []Warning{{
+		Query:   q.Name,
+		Message: fmt.Sprintf("Tables %s are not all linked by a join condition, possible Cartesian product", strings.Join(aliases, ", ")),
+	}}
+}
+
+// fromAlias returns the lower-cased name a FROM item is referenced by: its
+// alias, or the table name without schema
+func fromAlias(item string) string {
+	fields := strings.Fields(item)
+	switch {
+	case len(fields) == 0:
+		return ""
+	case strings.HasPrefix(fields[0], "("):
+		return strings.ToLower(fields[len(fields)-1])
+	case len(fields) >= 3 && strings.EqualFold(fields[1], "AS"):
+		return strings.ToLower(fields[2])
+	case len(fields) >= 2 && !sqlKeywords[strings.ToUpper(fields[1])]:
+		return strings.ToLower(fields[1])
+	}
+
+	name := fields[0]
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		name = name[i+1:]
+	}
+
+	return strings.ToLower(strings.Trim(name, `"`))
+}
+
+// lintNormalizedParams flags distinct parameter spellings merged into one
+// parameter by the normalizer, e.g. :user_id and :userId. Spellings differing
+// only in case are merged intentionally and not reported
+func lintNormalizedParams(q *Query) []Warning {
+	opts := q.options()
+	if opts.normalize == nil {
+		return nil
+	}
+
+	var (
+		warnings  []Warning
+		order     []string
+		spellings = make(map[string][]string)
+	)
+
+	for _, p := range scanParams(q.Raw, opts) {
+		name := opts.normalize(p.name)
+
+		known := spellings[name]
+		if len(known) == 0 {
+			order = append(order, name)
+		}
+
+		merged := false
+		for _, spelling := range known {
+			if strings.EqualFold(spelling, p.name) {
+				merged = true
+				break
+			}
+		}
+		if !merged {
+			spellings[name] = append(known, p.name)
+		}
+	}
+
+	for _, name := range order {
+		if known := spellings[name]; len(known) > 1 {
+			warnings = append(warnings, Warning{
+				Query:   q.Name,
+				Message: fmt.Sprintf("Parameters %s are all normalized to '%s'", strings.Join(known, ", "), name),
+			})
+		}
+	}
+
+	return warnings
+}
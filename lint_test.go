@@ -0,0 +1,131 @@
+package queries
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLintAdjacentParams(t *testing.T) {
+	testCases := []struct {
+		name     string
+		query    string
+		expected int
+	}{
+		{name: "glued", query: "SELECT * FROM users LIMIT:n", expected: 1},
+		{name: "spaced", query: "SELECT * FROM users LIMIT :n", expected: 0},
+		{name: "cast", query: "SELECT :id::int", expected: 0},
+		{name: "reserved", query: "SELECT to_char(ts, HH24:MI) FROM t", expected: 0},
+		{name: "literal", query: "SELECT * FROM notes WHERE note = 'see:id' AND id = :id -- see:id", expected: 0},
+		{name: "glued-quoted", query: "SELECT * FROM users WHERE name = 'a:b' LIMIT:'n'", expected: 1},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			warnings := NewQuery(tc.name, tc.query).Lint()
+			if len(warnings) != tc.expected {
+				t.Errorf("Lint() = %v; expected %d warnings", warnings, tc.expected)
+			}
+		})
+	}
+}
+
+func TestLintKeywordParams(t *testing.T) {
+	testCases := []struct {
+		name     string
+		query    string
+		expected int
+	}{
+		{name: "keyword", query: "SELECT * FROM orders ORDER BY :order", expected: 1},
+		{name: "keyword-case", query: "SELECT * FROM t WHERE a = :From AND b = :select", expected: 2},
+		{name: "prefixed", query: "SELECT * FROM orders WHERE id = :order_id", expected: 0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			warnings := lintKeywordParams(NewQuery(tc.name, tc.query))
+			if len(warnings) != tc.expected {
+				t.Errorf("lintKeywordParams() = %v; expected %d warnings", warnings, tc.expected)
+			}
+		})
+	}
+}
+
+func TestLintSwappedParams(t *testing.T) {
+	input := `-- name: transfer
+UPDATE accounts SET balance = balance - :amount WHERE id = :from_id
+
+-- name: transfer-copy
+UPDATE accounts SET balance = balance - :from_id WHERE id = :amount
+
+-- name: transfer-same
+UPDATE accounts SET balance = balance - :amount WHERE id = :from_id
+
+-- name: refund
+UPDATE accounts SET balance = balance + :amount WHERE id = :to_id`
+
+	store := NewQueryStore()
+	if err := store.loadQueriesFromFile("accounts.sql", strings.NewReader(input)); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	warnings := store.lintSwappedParams()
+	if len(warnings) != 1 {
+		t.Fatalf("lintSwappedParams() = %v; expected 1 warning", warnings)
+	}
+	if warnings[0].Query != "transfer-copy" || !strings.Contains(warnings[0].Message, "'transfer'") {
+		t.Errorf("unexpected warning %v", warnings[0])
+	}
+}
+
+func TestLintCartesianJoin(t *testing.T) {
+	testCases := []struct {
+		name     string
+		query    string
+		expected int
+	}{
+		{name: "comma-no-where", query: "SELECT * FROM users u, orders o", expected: 1},
+		{name: "comma-unrelated-where", query: "SELECT * FROM users u, orders o WHERE u.id = :id AND o.status = 'open'", expected: 1},
+		{name: "comma-linked", query: "SELECT * FROM users u, orders o WHERE o.user_id = u.id AND u.id = :id", expected: 0},
+		{name: "comma-table-names", query: "SELECT * FROM public.users, orders WHERE users.id = orders.user_id", expected: 0},
+		{name: "comma-partially-linked", query: "SELECT * FROM users u, orders o, items i WHERE o.user_id = u.id", expected: 1},
+		{name: "join", query: "SELECT * FROM users u JOIN orders o ON o.user_id = u.id WHERE u.id = :id", expected: 0},
+		{name: "single-table", query: "SELECT * FROM users WHERE id = :id", expected: 0},
+		{name: "function-args", query: "SELECT * FROM generate_series(1, 10) WHERE 1 = 1", expected: 0},
+		{name: "subquery", query: "SELECT * FROM users WHERE id IN (SELECT user_id FROM orders, items)", expected: 0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			warnings := lintCartesianJoin(NewQuery(tc.name, tc.query))
+			if len(warnings) != tc.expected {
+				t.Errorf("lintCartesianJoin() = %v; expected %d warnings", warnings, tc.expected)
+			}
+		})
+	}
+
+	warnings := NewQuery("cartesian", "SELECT * FROM users u, orders o").Lint()
+	if len(warnings) != 1 || !strings.Contains(warnings[0].Message, "Cartesian product") {
+		t.Errorf("expected Lint() to include the Cartesian join warning, got %v", warnings)
+	}
+}
+
+func TestLintNormalizedParams(t *testing.T) {
+	normalize := func(name string) string {
+		return strings.ToLower(strings.ReplaceAll(name, "_", ""))
+	}
+
+	q := NewQuery("find", "SELECT * FROM users WHERE id = :user_id OR parent_id = :userId OR owner_id = :USER_ID", WithParamNormalizer(normalize))
+	if len(q.Mapping) != 1 || q.Mapping["userid"] != 1 {
+		t.Errorf("unexpected mapping %v", q.Mapping)
+	}
+
+	warnings := lintNormalizedParams(q)
+	if len(warnings) != 1 || warnings[0].Message != "Parameters user_id, userId are all normalized to 'userid'" {
+		t.Errorf("unexpected warnings %v", warnings)
+	}
+
+	lower := NewQuery("find", "SELECT * FROM users WHERE id = :Id OR parent_id = :id", WithLowercaseParams())
+	if warnings := lower.Lint(); len(warnings) != 0 {
+		t.Errorf("expected case-only merges not to be reported, got %v", warnings)
+	}
+}
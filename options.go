@@ -0,0 +1,414 @@
+package queries
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+	"time"
+)
+
+type (
+	// Option configures the query store
+	Option func(*options)
+
+	// DuplicatePolicy decides what happens when a loaded query has the name
+	// of an already loaded one
+	DuplicatePolicy int
+
+	options struct {
+		lookupVar           func(name string) (string, bool)
+		strictExpand        bool
+		expandRepeats       bool
+		pathSeparator       string
+		followSymlinks      bool
+		strictExtensions    bool
+		resolvers           []func(name string) (interface{}, bool)
+		maxQueries          int
+		paramRegexp         *regexp.Regexp
+		normalize           func(name string) string
+		jsonNumbers         bool
+		duplicates          DuplicatePolicy
+		debugChecks         bool
+		readTimeout         time.Duration
+		derefPointers       bool
+		loadFilter          func(name string, metadata map[string]string) bool
+		commentMarkers      []string
+		dialect             Dialect
+		intern              bool
+		progress            func(loaded, total int)
+		strictNumbering     bool
+		reservedNames       []string
+		reservedIgnoreCase  bool
+		maxQueryLength      int
+		validate            bool
+		observer            func(name, ordinalSQL string, params []string) error
+		extensions          []string
+		skipFile            func(path string) bool
+		dirNamespacing      bool
+		caseInsensitiveArgs bool
+	}
+)
+
+const (
+	// DuplicateError fails the load (default)
+	DuplicateError DuplicatePolicy = iota
+	// DuplicateOverride replaces the earlier definition with the later one.
+	// The replacement inherits the usage tracked for UnusedQueries.
+	// Re-registering an identical query is a no-op
+	DuplicateOverride
+	// DuplicateIgnore disables the duplicate check: re-registering an
+	// identical query is a no-op and a differing one replaces the earlier
+	// definition as a brand new query
+	DuplicateIgnore
+)
+
+// defaultOptions are used by queries not created through NewQuery
+var defaultOptions = newOptions(nil)
+
+func newOptions(opts []Option) *options {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return o
+}
+
+// WithEnvExpansion expands ${VAR} references in metadata values using the
+// environment. SQL bodies are never expanded
+func WithEnvExpansion() Option {
+	return func(o *options) {
+		o.lookupVar = os.LookupEnv
+	}
+}
+
+// WithVarExpansion expands ${VAR} references in metadata values using the
+// supplied variables. SQL bodies are never expanded
+func WithVarExpansion(vars map[string]string) Option {
+	return func(o *options) {
+		o.lookupVar = func(name string) (string, bool) {
+			value, ok := vars[name]
+			return value, ok
+		}
+	}
+}
+
+// WithStrictExpansion makes references to unset variables fail the load
+// instead of expanding to an empty string
+func WithStrictExpansion() Option {
+	return func(o *options) {
+		o.strictExpand = true
+	}
+}
+
+// WithExpandRepeats gives every occurrence of a named parameter its own
+// ordinal placeholder, repeating the argument in Prepare
+func WithExpandRepeats() Option {
+	return func(o *options) {
+		o.expandRepeats = true
+	}
+}
+
+// WithPathNames names queries without a name tag after their file path
+// relative to the loaded directory, joining the subdirectories with sep.
+// With sep "." the file users/get.sql yields the query users.get
+func WithPathNames(sep string) Option {
+	return func(o *options) {
+		o.pathSeparator = sep
+	}
+}
+
+// WithDirNamespacing prefixes the names of all queries loaded by LoadFromDir
+// and LoadFromEmbed with their subdirectory, so the query get-sales from
+// reports/sales.sql is named reports.get-sales. Files in the loaded directory
+// itself are not prefixed
+func WithDirNamespacing() Option {
+	return func(o *options) {
+		o.dirNamespacing = true
+	}
+}
+
+// WithFollowSymlinks makes LoadFromDir descend into symlinked directories.
+// Every directory is loaded at most once, which also breaks symlink loops
+func WithFollowSymlinks() Option {
+	return func(o *options) {
+		o.followSymlinks = true
+	}
+}
+
+// WithStrictExtensions makes LoadFromDir and LoadFromEmbed fail on files
+// which are not .sql files instead of skipping them
+func WithStrictExtensions() Option {
+	return func(o *options) {
+		o.strictExtensions = true
+	}
+}
+
+// WithExtensions replaces the extensions of the files loaded by LoadFromDir
+// and LoadFromEmbed, .sql by default, e.g. WithExtensions(".sql", ".psql",
+// ".sql.tmpl"). Extensions are matched case-insensitively and stripped from
+// the query names derived from file names
+func WithExtensions(extensions ...string) Option {
+	return func(o *options) {
+		o.extensions = extensions
+	}
+}
+
+// WithSkipFunc makes LoadFromDir and LoadFromEmbed ignore the files for
+// which skip, given the file path, returns true. Skipped files are neither
+// loaded nor reported by SkippedFiles
+func WithSkipFunc(skip func(path string) bool) Option {
+	return func(o *options) {
+		o.skipFile = skip
+	}
+}
+
+// WithResolver registers a function supplying values of parameters missing
+// from the arguments passed to Prepare. Resolvers are consulted in the order
+// they were registered
+func WithResolver(resolve func(name string) (interface{}, bool)) Option {
+	return func(o *options) {
+		o.resolvers = append(o.resolvers, resolve)
+	}
+}
+
+// WithMaxQueryLength rejects queries whose compiled SQL exceeds n
+// characters, a guard against runaway generated SQL. Loading fails on such
+// a query and PrepareExpanded errors when the expanded query is too long
+func WithMaxQueryLength(n int) Option {
+	return func(o *options) {
+		o.maxQueryLength = n
+	}
+}
+
+// WithValidation runs Validate on every loaded query, failing the load on
+// :name tokens left in the ordinal query
+func WithValidation() Option {
+	return func(o *options) {
+		o.validate = true
+	}
+}
+
+// WithCompileObserver calls observe with every query registered during
+// loading, e.g. to feed the SQL to an external linter. It is called once the
+// store is unlocked, so it may call back into the store. A non-nil error
+// returned by observe fails the load and unregisters the rejected query and
+// the ones loaded after it
+func WithCompileObserver(observe func(name, ordinalSQL string, params []string) error) Option {
+	return func(o *options) {
+		o.observer = observe
+	}
+}
+
+// WithMaxQueries makes loading fail once the store would hold more than n
+// queries
+func WithMaxQueries(n int) Option {
+	return func(o *options) {
+		o.maxQueries = n
+	}
+}
+
+// WithParamPattern replaces the regular expression matching parameter names,
+// [A-Za-z][A-Za-z0-9_]* by default. For example [A-Za-z_][A-Za-z0-9_]*
+// accepts a leading underscore. The pattern may only match ASCII letters,
+// digits and underscores; WithParamPattern panics when it is invalid
+func WithParamPattern(pattern string) Option {
+	if err := validateParamPattern(pattern); err != nil {
+		panic(err)
+	}
+
+	re := regexp.MustCompile(fmt.Sprintf(psqlVarRE, pattern))
+
+	return func(o *options) {
+		o.paramRegexp = re
+	}
+}
+
+// validateParamPattern checks the pattern compiles and cannot match anything
+// but identifier characters
+func validateParamPattern(pattern string) error {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return fmt.Errorf("Invalid parameter pattern '%s': %v", pattern, err)
+	}
+
+	if err := checkParamSyntax(re); err != nil {
+		return fmt.Errorf("Invalid parameter pattern '%s': %v", pattern, err)
+	}
+
+	return nil
+}
+
+func checkParamSyntax(re *syntax.Regexp) error {
+	switch re.Op {
+	case syntax.OpLiteral:
+		for _, r := range re.Rune {
+			if !isParamRune(r) {
+				return fmt.Errorf("matches unsafe character %q", r)
+			}
+		}
+	case syntax.OpCharClass:
+		for i := 0; i < len(re.Rune); i += 2 {
+			for r := re.Rune[i]; r <= re.Rune[i+1]; r++ {
+				if !isParamRune(r) {
+					return fmt.Errorf("matches unsafe character %q", r)
+				}
+			}
+		}
+	case syntax.OpConcat, syntax.OpAlternate, syntax.OpCapture,
+		syntax.OpStar, syntax.OpPlus, syntax.OpQuest, syntax.OpRepeat:
+		for _, sub := range re.Sub {
+			if err := checkParamSyntax(sub); err != nil {
+				return err
+			}
+		}
+	case syntax.OpEmptyMatch:
+	default:
+		return fmt.Errorf("unsupported expression %s", re)
+	}
+
+	return nil
+}
+
+func isParamRune(r rune) bool {
+	return r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9'
+}
+
+// WithLowercaseParams lowercases parameter names in the mapping and the
+// argument names passed to Prepare, making the binding case-insensitive
+func WithLowercaseParams() Option {
+	return func(o *options) {
+		o.normalize = strings.ToLower
+	}
+}
+
+// WithCaseInsensitiveArgs matches the argument names passed to Prepare to
+// the parameter names case-insensitively, e.g. the userid argument binds
+// :userID. The mapping and the ordinal query keep the original casing.
+// Loading fails on queries with parameters differing only in case
+func WithCaseInsensitiveArgs() Option {
+	return func(o *options) {
+		o.caseInsensitiveArgs = true
+	}
+}
+
+// WithParamNormalizer applies normalize to parameter names in the mapping
+// and to the argument names passed to Prepare. Distinct spellings merged by
+// the normalizer (other than by case) are reported by Lint
+func WithParamNormalizer(normalize func(name string) string) Option {
+	return func(o *options) {
+		o.normalize = normalize
+	}
+}
+
+// WithJSONNumbers makes PrepareJSON bind integral JSON numbers as int64
+// instead of float64
+func WithJSONNumbers() Option {
+	return func(o *options) {
+		o.jsonNumbers = true
+	}
+}
+
+// WithDuplicatePolicy sets how loading a query with an already used name is
+// handled
+func WithDuplicatePolicy(policy DuplicatePolicy) Option {
+	return func(o *options) {
+		o.duplicates = policy
+	}
+}
+
+// WithDebugChecks makes Prepare panic when the number of prepared arguments
+// does not match the placeholders of the ordinal query. Meant for
+// development, it catches compilation and binding drift early
+func WithDebugChecks() Option {
+	return func(o *options) {
+		o.debugChecks = true
+	}
+}
+
+// WithReadTimeout bounds the time spent reading each loaded file. A read
+// exceeding d fails the load with an error naming the file; the stuck read
+// itself is abandoned, not interrupted
+func WithReadTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.readTimeout = d
+	}
+}
+
+// WithDerefPointers makes Prepare bind typed nil pointers as untyped nil and
+// non-nil pointers as the values they point to, so NULL is bound consistently
+// regardless of the driver. Pointers implementing driver.Valuer are kept
+func WithDerefPointers() Option {
+	return func(o *options) {
+		o.derefPointers = true
+	}
+}
+
+// WithLoadFilter loads only the queries for which filter, given the query
+// name and its metadata, returns true. The others are skipped silently
+func WithLoadFilter(filter func(name string, metadata map[string]string) bool) Option {
+	return func(o *options) {
+		o.loadFilter = filter
+	}
+}
+
+// WithCommentMarkers strips comments starting with any of the markers (e.g.
+// "#" for MySQL) from the query text, so they are neither part of the query
+// nor scanned for parameters. Name and metadata headers still use --
+func WithCommentMarkers(markers ...string) Option {
+	return func(o *options) {
+		o.commentMarkers = markers
+	}
+}
+
+// WithDialect compiles the queries to the placeholders of the dialect: $N for
+// Postgres (default), ? for MySQL and SQLite, @pN for SQL Server and :N for
+// Oracle. With ? placeholders every occurrence of a repeated parameter is
+// bound separately
+func WithDialect(dialect Dialect) Option {
+	return func(o *options) {
+		o.dialect = dialect
+	}
+}
+
+// WithInterning makes queries with identical bodies share a single copy of
+// Raw, saving memory in large stores with many repeated queries
+func WithInterning() Option {
+	return func(o *options) {
+		o.intern = true
+	}
+}
+
+// WithProgress makes LoadFromDir report its progress after every loaded
+// .sql file. The total is counted in a first pass over the directory
+func WithProgress(progress func(loaded, total int)) Option {
+	return func(o *options) {
+		o.progress = progress
+	}
+}
+
+// WithStrictNumbering makes OrderedByNumericPrefix fail on duplicate numbers
+// and gaps in the numbering
+func WithStrictNumbering() Option {
+	return func(o *options) {
+		o.strictNumbering = true
+	}
+}
+
+// WithReservedNames replaces the names which are never treated as
+// parameters, MI and SS (TO_CHAR format pieces as in HH24:MI:SS) by default.
+// Names are matched case-sensitively
+func WithReservedNames(names []string) Option {
+	return func(o *options) {
+		o.reservedNames = append([]string{}, names...)
+	}
+}
+
+// WithReservedNamesIgnoreCase matches the reserved names case-insensitively
+func WithReservedNamesIgnoreCase() Option {
+	return func(o *options) {
+		o.reservedIgnoreCase = true
+	}
+}
@@ -2,28 +2,77 @@ package queries
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/rand"
+	"database/sql/driver"
 	"embed"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"os"
+	pathpkg "path"
 	"path/filepath"
+	"reflect"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
 )
 
 const (
-	psqlVarRE = `[^:]:['"]?([A-Za-z][A-Za-z0-9_]*)['"]?`
+	paramNameRE = `[A-Za-z][A-Za-z0-9_]*`
+	psqlVarRE   = `^:['"]?(@?(?:%s))['"]?`
+
+	// redactedValue replaces argument values in LogFields
+	redactedValue = "[REDACTED]"
+
+	// placeholder styles selectable per query with the `-- style:` metadata
+	styleDollar   = "dollar"
+	styleQuestion = "question"
+)
+
+var (
+	// ErrQueryNotFound is returned when looking up a query which is not loaded
+	ErrQueryNotFound = errors.New("not found")
+	// ErrDuplicateQuery is returned when loading a query whose name is taken
+	ErrDuplicateQuery = errors.New("already exists")
 )
 
 var (
 	reservedNames = []string{"MI", "SS"}
+
+	// autoParams are filled by Prepare unless provided by the caller
+	autoParams = map[string]func() interface{}{
+		"@now":  func() interface{} { return time.Now() },
+		"@uuid": func() interface{} { return newUUID() },
+	}
+
+	psqlVarRegexp = regexp.MustCompile(fmt.Sprintf(psqlVarRE, paramNameRE))
+	// defaultExtensions are the query file extensions loaded from directories
+	defaultExtensions = []string{".sql"}
+	metadataVarRE     = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
 )
 
 type (
 	QueryStore struct {
+		// mu guards the queries, their usage and the skipped files
+		mu      sync.RWMutex
 		queries map[string]*Query
+		// uses counts lookups of each query through Query
+		uses map[string]*int64
+		// skipped holds files ignored by the directory loaders
+		skipped []string
+		// interned holds the query bodies shared when interning is enabled
+		interned map[string]string
+		// loaded counts the registered queries, giving them a source order
+		loaded int
+		opts   *options
 	}
 
 	Query struct {
@@ -31,25 +80,75 @@ type (
 		Raw          string
 		OrdinalQuery string
 		Mapping      map[string]int
+		Metadata     map[string]string
+		// Source is the file the query was loaded from
+		Source string
+		// SourceLine is the line of Source with the name tag of the query,
+		// or its first line when the query is named after the file
+		SourceLine int
+		// InTransaction is set by the `-- tx: true` metadata, Exec runs such
+		// queries inside a transaction
+		InTransaction bool
+		// ResultColumns are the result columns declared by the
+		// `-- returns: id int, name text` metadata
+		ResultColumns []ResultColumn
+		// Defaults are the values bound to missing parameters, declared by
+		// `-- default limit: 50` lines. Values are int64, string or nil
+		Defaults map[string]interface{}
+		// Group is set by the `-- group: setup` metadata, see QueriesInGroup
+		Group string
+
+		opts   *options
+		layout map[string][]int
+		// params holds the parameter name of each ordinal placeholder
+		params []string
+		// occurrences counts the appearances of each parameter in Raw
+		occurrences map[string]int
+		// seq is the position of the query in the load order
+		seq int
+	}
+
+	// ResultColumn is an expected result column of a query
+	ResultColumn struct {
+		Name string
+		Type string
+	}
+
+	// QueryReader provides read-only access to the queries
+	QueryReader interface {
+		Query(name string) (*Query, error)
+		Has(name string) bool
+		Names() []string
+	}
+
+	readOnlyStore struct {
+		store *QueryStore
+	}
+
+	namespaceView struct {
+		store  *QueryStore
+		prefix string
+	}
+
+	// EmbedEntry pairs an embedded filesystem with the path to load from it
+	EmbedEntry struct {
+		FS   embed.FS
+		Path string
 	}
 )
 
 // NewQueryStore setups new query store
-func NewQueryStore() *QueryStore {
+func NewQueryStore(opts ...Option) *QueryStore {
 	return &QueryStore{
 		queries: make(map[string]*Query),
+		uses:    make(map[string]*int64),
+		opts:    newOptions(opts),
 	}
 }
 
 // LoadFromFile loads query/queries from specified file
 func (s *QueryStore) LoadFromFile(fileName string) (err error) {
-	file, err := os.Open(fileName)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-
-	return s.loadQueriesFromFile(fileName, file)
+	return s.loadFile(fileName, "", "")
 }
 
 func (s *QueryStore) LoadFromDir(path string) error {
@@ -57,48 +156,296 @@ func (s *QueryStore) LoadFromDir(path string) error {
 		return fmt.Errorf("Directory does not exist: %s", path)
 	}
 
-	err := filepath.Walk(path, func(filePath string, info os.FileInfo, err error) error {
+	load := func(virtualPath, rel string) error {
+		if s.excluded(virtualPath) {
+			return nil
+		}
+		if !s.isQueryFile(virtualPath) {
+			return s.skipFile(virtualPath)
+		}
+
+		err := s.loadFile(virtualPath, s.pathName(filepath.ToSlash(rel)), s.namespace(filepath.ToSlash(rel)))
 		if err != nil {
+			return fmt.Errorf("Error loading SQL file '%s': %w", virtualPath, err)
+		}
+
+		return nil
+	}
+
+	progress := s.opts.progress
+	if progress == nil {
+		return s.walkDir(path, path, path, make(map[string]bool), load)
+	}
+
+	// the first pass counts the files for the progress total
+	var total, loaded int
+	err := s.walkDir(path, path, path, make(map[string]bool), func(virtualPath, rel string) error {
+		if !s.excluded(virtualPath) && s.isQueryFile(virtualPath) {
+			total++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.walkDir(path, path, path, make(map[string]bool), func(virtualPath, rel string) error {
+		if err := load(virtualPath, rel); err != nil {
 			return err
 		}
 
-		if !info.IsDir() && strings.HasSuffix(strings.ToLower(filePath), ".sql") {
-			err = s.LoadFromFile(filePath)
-			if err != nil {
-				return fmt.Errorf("Error loading SQL file '%s': %v", filePath, err)
-			}
+		if !s.excluded(virtualPath) && s.isQueryFile(virtualPath) {
+			loaded++
+			progress(loaded, total)
 		}
 
 		return nil
 	})
+}
 
-	return err
+// walkDir calls visit for the files found in dir with their path relative to
+// root. Files are reported under the virtual path, which differs from dir
+// when walking a followed symlink. Visited holds the resolved directories to
+// break symlink loops
+func (s *QueryStore) walkDir(root, dir, virtual string, visited map[string]bool, visit func(virtualPath, rel string) error) error {
+	return filepath.Walk(dir, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, filePath)
+		if err != nil {
+			return err
+		}
+		virtualPath := filepath.Join(virtual, rel)
+
+		if s.opts.followSymlinks {
+			if info.IsDir() {
+				real, err := filepath.EvalSymlinks(filePath)
+				if err != nil {
+					return err
+				}
+				if visited[real] {
+					return filepath.SkipDir
+				}
+				visited[real] = true
+
+				return nil
+			}
+
+			if info.Mode()&os.ModeSymlink != 0 {
+				real, err := filepath.EvalSymlinks(filePath)
+				if err != nil {
+					return err
+				}
+
+				target, err := os.Stat(real)
+				if err != nil {
+					return err
+				}
+				if target.IsDir() {
+					if visited[real] {
+						return nil
+					}
+
+					return s.walkDir(root, real, virtualPath, visited, visit)
+				}
+			}
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		rel, err = filepath.Rel(root, virtualPath)
+		if err != nil {
+			return err
+		}
+
+		return visit(virtualPath, rel)
+	})
 }
 
+// LoadFromEmbed loads queries from all .sql files (or the extensions set by
+// WithExtensions) found under path of the embedded filesystem, including
+// its subdirectories
 func (qs *QueryStore) LoadFromEmbed(sqlFS embed.FS, path string) error {
-	dirEntries, err := fs.ReadDir(sqlFS, path)
+	return qs.LoadFromFS(sqlFS, path)
+}
+
+// LoadFromFS loads queries from all .sql files (or the extensions set by
+// WithExtensions) found under path of the filesystem, including its
+// subdirectories, e.g. of an os.DirFS or a fstest.MapFS
+func (qs *QueryStore) LoadFromFS(sqlFS fs.FS, path string) error {
+	root := strings.TrimSuffix(path, "/")
+	if root == "" {
+		root = "."
+	}
+
+	return fs.WalkDir(sqlFS, root, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if entry.IsDir() {
+			return nil
+		}
+
+		if qs.excluded(filePath) {
+			return nil
+		}
+		if !qs.isQueryFile(filePath) {
+			return qs.skipFile(filePath)
+		}
+
+		file, err := sqlFS.Open(filePath)
+		if err != nil {
+			return fmt.Errorf("Error opening SQL file '%s': %w", filePath, err)
+		}
+		defer file.Close()
+
+		rel := strings.TrimPrefix(filePath, root+"/")
+		if root == "." {
+			rel = filePath
+		}
+
+		err = qs.loadQueries(filePath, qs.pathName(rel), qs.namespace(rel), file)
+		if err != nil {
+			return fmt.Errorf("Error loading SQL file '%s': %w", filePath, err)
+		}
+
+		return nil
+	})
+}
+
+// LoadFromEmbeds loads queries from several embedded filesystems in order,
+// as if LoadFromEmbed was called for each entry
+func (s *QueryStore) LoadFromEmbeds(entries ...EmbedEntry) error {
+	for _, entry := range entries {
+		if err := s.LoadFromEmbed(entry.FS, entry.Path); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// LoadFromFSFile loads queries from an already opened file, e.g. of a
+// virtual filesystem. The file is named by name and is not closed
+func (s *QueryStore) LoadFromFSFile(name string, f fs.File) error {
+	return s.loadQueriesFromFile(name, f)
+}
+
+// LoadFromTemplate renders the text/template with data and loads the
+// queries from the output. Statements without a name tag are named by name
+func (s *QueryStore) LoadFromTemplate(name string, tmpl string, data interface{}) error {
+	t, err := template.New(name).Parse(tmpl)
+	if err != nil {
+		return fmt.Errorf("Error parsing template '%s': %v", name, err)
+	}
+
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return fmt.Errorf("Error rendering template '%s': %v", name, err)
+	}
+
+	return s.loadQueries(name, name, "", &buf)
+}
+
+// skipFile records a file ignored by the directory loaders, failing in strict
+// mode
+func (s *QueryStore) skipFile(fileName string) error {
+	if s.opts.strictExtensions {
+		return fmt.Errorf("Unexpected file '%s' in query directory", fileName)
+	}
+
+	s.mu.Lock()
+	s.skipped = append(s.skipped, fileName)
+	s.mu.Unlock()
+
+	return nil
+}
+
+// SkippedFiles returns the files ignored by LoadFromDir and LoadFromEmbed
+// because they do not have a query file extension. Files excluded by
+// WithSkipFunc are not listed
+func (s *QueryStore) SkippedFiles() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return append([]string(nil), s.skipped...)
+}
+
+func (s *QueryStore) loadFile(fileName, name, namespace string) error {
+	file, err := os.Open(fileName)
 	if err != nil {
 		return err
 	}
+	defer file.Close()
 
-	for _, entry := range dirEntries {
-		filePath := entry.Name()
+	return s.loadQueries(fileName, name, namespace, file)
+}
 
-		if !entry.IsDir() && strings.HasSuffix(strings.ToLower(filePath), ".sql") {
-			file, err := sqlFS.Open(filepath.Join(path, filePath))
-			if err != nil {
-				return fmt.Errorf("Error opening SQL file '%s': %v", filePath, err)
-			}
-			defer file.Close()
+// pathName derives the default query name from the slash separated path
+// relative to the loaded directory, without the query file extension.
+// Without WithPathNames, or with WithDirNamespacing, the base file name is
+// used
+func (s *QueryStore) pathName(rel string) string {
+	ext, ok := s.queryExt(rel)
+	if !ok {
+		ext = pathpkg.Ext(rel)
+	}
+	rel = rel[:len(rel)-len(ext)]
 
-			err = qs.loadQueriesFromFile(filePath, file)
-			if err != nil {
-				return fmt.Errorf("Error loading SQL file '%s': %v", filePath, err)
-			}
+	if s.opts.pathSeparator == "" || s.opts.dirNamespacing {
+		return pathpkg.Base(rel)
+	}
+
+	return strings.ReplaceAll(rel, "/", s.opts.pathSeparator)
+}
+
+// namespace returns the prefix of the queries loaded from the slash
+// separated path, the directory joined with dots and followed by a dot, e.g.
+// reports.monthly. for reports/monthly/sales.sql. Files in the loaded
+// directory itself get no prefix
+func (s *QueryStore) namespace(rel string) string {
+	dir := pathpkg.Dir(rel)
+	if !s.opts.dirNamespacing || dir == "." {
+		return ""
+	}
+
+	return strings.ReplaceAll(dir, "/", ".") + "."
+}
+
+// queryExt returns the longest query file extension the file name ends
+// with, compared case-insensitively
+func (s *QueryStore) queryExt(fileName string) (string, bool) {
+	extensions := s.opts.extensions
+	if len(extensions) == 0 {
+		extensions = defaultExtensions
+	}
+
+	var (
+		match string
+		lower = strings.ToLower(fileName)
+	)
+	for _, ext := range extensions {
+		if len(ext) > len(match) && strings.HasSuffix(lower, strings.ToLower(ext)) {
+			match = ext
 		}
 	}
 
-	return nil
+	return match, match != ""
+}
+
+func (s *QueryStore) isQueryFile(fileName string) bool {
+	_, ok := s.queryExt(fileName)
+	return ok
+}
+
+// excluded reports whether the file is skipped by the WithSkipFunc filter
+func (s *QueryStore) excluded(fileName string) bool {
+	return s.opts.skipFile != nil && s.opts.skipFile(fileName)
 }
 
 // MustHaveQuery returns query or panics on error
@@ -113,111 +460,1770 @@ func (s *QueryStore) MustHaveQuery(name string) *Query {
 
 // Query retrieve query by given name
 func (s *QueryStore) Query(name string) (*Query, error) {
+	s.mu.RLock()
 	query, ok := s.queries[name]
+	uses := s.uses[name]
+	s.mu.RUnlock()
+
 	if !ok {
-		return nil, fmt.Errorf("Query '%s' not found", name)
+		return nil, fmt.Errorf("Query '%s' %w", name, ErrQueryNotFound)
 	}
 
+	atomic.AddInt64(uses, 1)
+
 	return query, nil
 }
 
-func (s *QueryStore) loadQueriesFromFile(fileName string, r io.Reader) error {
-	scanner := &Scanner{}
-	newQueries := scanner.Run(fileName, bufio.NewScanner(r))
+// QuerySafe retrieves query by given name, it is equivalent to Query and
+// never panics
+func (s *QueryStore) QuerySafe(name string) (*Query, error) {
+	return s.Query(name)
+}
+
+// TryQuery retrieves the query and calls fn with it. A panic within fn, e.g.
+// of Must-style code, is recovered and returned as an error
+func (s *QueryStore) TryQuery(name string, fn func(q *Query) error) (err error) {
+	q, err := s.Query(name)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Query '%s' panicked: %v", name, r)
+		}
+	}()
+
+	return fn(q)
+}
+
+// Has reports whether the query with given name is loaded
+func (s *QueryStore) Has(name string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
-	for name, query := range newQueries {
-		// insert query (but check whatever it already exists)
-		if _, ok := s.queries[name]; ok {
-			return fmt.Errorf("Query '%s' already exists", name)
+	_, ok := s.queries[name]
+	return ok
+}
+
+// QueriesWithPrefix returns the queries whose names start with prefix, e.g.
+// "users." for all queries of the users namespace. The returned map is a copy
+func (s *QueryStore) QueriesWithPrefix(prefix string) map[string]*Query {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	queries := make(map[string]*Query)
+	for name, query := range s.queries {
+		if strings.HasPrefix(name, prefix) {
+			queries[name] = query
 		}
+	}
 
-		q := NewQuery(name, query)
+	return queries
+}
+
+// QueriesInGroup returns the queries marked with the `-- group: name`
+// metadata in the order they were loaded, e.g. to run setup statements as
+// one unit
+func (s *QueryStore) QueriesInGroup(name string) ([]*Query, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
-		s.queries[name] = q
+	var queries []*Query
+	for _, q := range s.queries {
+		if q.Group == name {
+			queries = append(queries, q)
+		}
+	}
+	if len(queries) == 0 {
+		return nil, fmt.Errorf("Group '%s' %w", name, ErrQueryNotFound)
 	}
 
-	return nil
+	sort.Slice(queries, func(i, j int) bool {
+		return queries[i].seq < queries[j].seq
+	})
+
+	return queries, nil
 }
 
-func NewQuery(name, query string) *Query {
-	var (
-		position int = 1
-	)
+// QueriesWithParams returns the sorted names of the queries whose set of
+// parameters equals the given names, regardless of order
+func (s *QueryStore) QueriesWithParams(names ...string) []string {
+	wanted := make(map[string]bool, len(names))
+	for _, name := range names {
+		wanted[name] = true
+	}
 
-	q := Query{
-		Name: name,
-		Raw:  query,
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	matching := []string{}
+	for _, name := range s.names() {
+		mapping := s.queries[name].Mapping
+		if len(mapping) != len(wanted) {
+			continue
+		}
+
+		equal := true
+		for param := range mapping {
+			if !wanted[param] {
+				equal = false
+				break
+			}
+		}
+		if equal {
+			matching = append(matching, name)
+		}
+	}
+
+	return matching
+}
+
+// OrderedByNumericPrefix returns the names of the queries starting with
+// a number, e.g. 0001_init, ordered by that number. Other queries are left
+// out. With WithStrictNumbering duplicate numbers and gaps are an error
+func (s *QueryStore) OrderedByNumericPrefix() ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	type numbered struct {
+		name   string
+		number int
 	}
 
-	mapping := make(map[string]int)
+	var ordered []numbered
+	for _, name := range s.names() {
+		digits := len(name) - len(strings.TrimLeft(name, "0123456789"))
+		if digits == 0 {
+			continue
+		}
+
+		number, err := strconv.Atoi(name[:digits])
+		if err != nil {
+			return nil, fmt.Errorf("Query '%s' has invalid numeric prefix: %v", name, err)
+		}
+
+		ordered = append(ordered, numbered{name: name, number: number})
+	}
 
-	r, _ := regexp.Compile(psqlVarRE)
-	matches := r.FindAllStringSubmatch(query, -1)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ordered[i].number < ordered[j].number
+	})
 
-	for _, match := range matches {
-		variable := match[1]
+	names := make([]string, len(ordered))
+	for i, q := range ordered {
+		names[i] = q.name
 
-		if isReservedName(variable) {
+		if !s.opts.strictNumbering || i == 0 {
 			continue
 		}
 
-		if _, ok := mapping[variable]; !ok {
-			mapping[variable] = position
-			position++
+		prev := ordered[i-1]
+		switch {
+		case q.number == prev.number:
+			return nil, fmt.Errorf("Queries '%s' and '%s' share the number %d", prev.name, q.name, q.number)
+		case q.number > prev.number+1:
+			return nil, fmt.Errorf("Missing number %d between queries '%s' and '%s'", prev.number+1, prev.name, q.name)
 		}
 	}
 
-	// replace the variable with ordinal markers
-	for name, ord := range mapping {
-		r, _ := regexp.Compile(fmt.Sprintf(`:["']?%s["']?`, name))
-		query = r.ReplaceAllLiteralString(query, fmt.Sprintf("$%d", ord))
+	return names, nil
+}
+
+// Require returns an error listing the given query names which are not loaded
+func (s *QueryStore) Require(names ...string) error {
+	var missing []string
+	for _, name := range names {
+		if !s.Has(name) {
+			missing = append(missing, name)
+		}
 	}
 
-	q.OrdinalQuery = fmt.Sprintf("-- %s\n%s", name, query)
-	q.Mapping = mapping
+	if len(missing) > 0 {
+		return fmt.Errorf("Required queries %w: %s", ErrQueryNotFound, strings.Join(missing, ", "))
+	}
 
-	return &q
+	return nil
 }
 
-// Query returns ordinal query
-func (q *Query) Query() string {
-	return q.OrdinalQuery
+// Compile runs the validation checks over all loaded queries: no :name
+// left in the ordinal query, ordinals bound exactly once and no parameters
+// differing only in case. The failures of all queries are joined into a
+// single error, one per line, ordered by query name
+func (s *QueryStore) Compile() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var errs []error
+	for _, name := range s.names() {
+		q := s.queries[name]
+		for _, check := range []func() error{q.Validate, q.checkOrdinals, q.checkCaseAmbiguity} {
+			if err := check(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	return errors.Join(errs...)
 }
 
-// Prepare the arguments for the ordinal query. Missing arguments will
-// be returned as nil
-func (q *Query) Prepare(args map[string]interface{}) []interface{} {
-	type kv struct {
-		Name string
-		Ord  int
+// MustCompile is like Compile but panics on failure, e.g. for package-level
+// initialization
+func (s *QueryStore) MustCompile() {
+	if err := s.Compile(); err != nil {
+		panic(err)
 	}
+}
+
+// Names returns sorted names of all loaded queries
+func (s *QueryStore) Names() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.names()
+}
 
-	var components []interface{}
+// Len returns the number of loaded queries
+func (s *QueryStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
-	// number of components is query and ordinal mapping count
-	components = make([]interface{}, len(q.Mapping))
-	var params []kv
-	for k, v := range q.Mapping {
-		params = append(params, kv{k, v})
+	return len(s.queries)
+}
+
+// names returns sorted names of all loaded queries, the caller holds the lock
+func (s *QueryStore) names() []string {
+	names := make([]string, 0, len(s.queries))
+	for name := range s.queries {
+		names = append(names, name)
 	}
+	sort.Strings(names)
 
-	sort.Slice(params, func(i, j int) bool {
-		return params[i].Ord < params[j].Ord
-	})
+	return names
+}
+
+// ReadOnly returns a read-only snapshot of the store. Queries loaded after
+// the snapshot was taken are not visible through it
+func (s *QueryStore) ReadOnly() QueryReader {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
-	for i, param := range params {
-		components[i] = args[param.Name]
+	queries := make(map[string]*Query, len(s.queries))
+	uses := make(map[string]*int64, len(s.uses))
+	for name, query := range s.queries {
+		queries[name] = query
+		uses[name] = s.uses[name]
 	}
 
-	return components
+	return &readOnlyStore{
+		store: &QueryStore{queries: queries, uses: uses, opts: s.opts},
+	}
 }
 
-func isReservedName(name string) bool {
-	for _, res := range reservedNames {
-		if name == res {
-			return true
+// Namespace returns a view of the queries in the namespace, looked up by
+// their names without the namespace, so Namespace("users").Query("get")
+// returns users.get. The namespace is joined with the WithPathNames
+// separator, "." by default as with WithDirNamespacing. Nested namespaces
+// are written with the same separator
+func (s *QueryStore) Namespace(namespace string) QueryReader {
+	sep := s.opts.pathSeparator
+	if sep == "" || s.opts.dirNamespacing {
+		sep = "."
+	}
+
+	return &namespaceView{store: s, prefix: namespace + sep}
+}
+
+func (v *namespaceView) Query(name string) (*Query, error) {
+	return v.store.Query(v.prefix + name)
+}
+
+func (v *namespaceView) Has(name string) bool {
+	return v.store.Has(v.prefix + name)
+}
+
+func (v *namespaceView) Names() []string {
+	names := []string{}
+	for _, name := range v.store.Names() {
+		if strings.HasPrefix(name, v.prefix) {
+			names = append(names, strings.TrimPrefix(name, v.prefix))
 		}
 	}
 
-	return false
+	return names
+}
+
+func (r *readOnlyStore) Query(name string) (*Query, error) {
+	return r.store.Query(name)
+}
+
+func (r *readOnlyStore) Has(name string) bool {
+	return r.store.Has(name)
+}
+
+func (r *readOnlyStore) Names() []string {
+	return r.store.Names()
+}
+
+func (s *QueryStore) loadQueriesFromFile(fileName string, r io.Reader) error {
+	return s.loadQueries(fileName, "", "", r)
+}
+
+// loadQueries registers the queries read from r. Statements preceding the
+// first name tag are named by name, or by the base file name when empty.
+// All query names are prefixed by namespace
+func (s *QueryStore) loadQueries(fileName, name, namespace string, r io.Reader) error {
+	if s.opts.readTimeout > 0 {
+		data, err := readWithTimeout(r, s.opts.readTimeout)
+		if err != nil {
+			return fmt.Errorf("Error reading SQL file '%s': %w", fileName, err)
+		}
+		r = bytes.NewReader(data)
+	}
+
+	scanner := &Scanner{name: name, comments: s.opts.commentMarkers}
+	newQueries := scanner.Run(fileName, bufio.NewScanner(r))
+
+	// the filter runs before locking the store, so it may call back into it
+	var selected []string
+	expanded := make(map[string]map[string]string, len(scanner.order))
+	for _, scanned := range scanner.order {
+		name := namespace + scanned
+
+		metadata, err := s.expandMetadata(scanner.metadata[scanned])
+		if err != nil {
+			return fmt.Errorf("Query '%s': %v", name, err)
+		}
+
+		if s.opts.loadFilter != nil && !s.opts.loadFilter(name, metadata) {
+			continue
+		}
+
+		selected = append(selected, scanned)
+		expanded[scanned] = metadata
+	}
+
+	// the observer is notified once the store is unlocked, so it may call
+	// back into it, and only about the queries actually registered
+	var registered []registration
+	err := func() error {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		for _, scanned := range selected {
+			query := newQueries[scanned]
+			name := namespace + scanned
+			metadata := expanded[scanned]
+
+			if err := checkInvisible(query); err != nil {
+				return fmt.Errorf("Query '%s': %v", name, err)
+			}
+
+			if style, ok := metadata["style"]; ok && !isPlaceholderStyle(style) {
+				return fmt.Errorf("Query '%s' has unknown placeholder style '%s'", name, style)
+			}
+
+			inTransaction, err := parseTransaction(metadata)
+			if err != nil {
+				return fmt.Errorf("Query '%s': %v", name, err)
+			}
+
+			columns, err := parseResultColumns(metadata)
+			if err != nil {
+				return fmt.Errorf("Query '%s': %v", name, err)
+			}
+
+			defaults := parseDefaults(scanner.defaults[scanned], s.opts.normalize)
+
+			if s.opts.intern {
+				query = s.intern(query)
+			}
+
+			q := &Query{
+				Name:          name,
+				Raw:           query,
+				Metadata:      metadata,
+				Source:        fileName,
+				SourceLine:    scanner.lines[scanned],
+				InTransaction: inTransaction,
+				ResultColumns: columns,
+				Defaults:      defaults,
+				Group:         metadata["group"],
+				opts:          s.opts,
+			}
+
+			// reloading an unchanged query is a no-op unless duplicates fail
+			if existing, ok := s.queries[name]; ok && s.opts.duplicates != DuplicateError && sameDefinition(existing, q) {
+				continue
+			}
+
+			q.compile()
+
+			if err := q.checkOrdinals(); err != nil {
+				return err
+			}
+
+			if s.opts.caseInsensitiveArgs {
+				if err := q.checkCaseAmbiguity(); err != nil {
+					return err
+				}
+			}
+
+			if err := q.checkStrayOrdinals(); err != nil {
+				return err
+			}
+
+			if err := q.checkLength(q.body()); err != nil {
+				return err
+			}
+
+			if s.opts.validate {
+				if err := q.Validate(); err != nil {
+					return err
+				}
+			}
+
+			replaced := s.queries[name]
+			if err := s.register(q); err != nil {
+				return err
+			}
+			registered = append(registered, registration{query: q, replaced: replaced})
+		}
+
+		return nil
+	}()
+
+	if observed := s.notifyObserver(registered); err == nil {
+		err = observed
+	}
+
+	return err
+}
+
+// registration is a query registered by a load, with the definition it
+// replaced if any
+type registration struct {
+	query    *Query
+	replaced *Query
+}
+
+// notifyObserver passes the registered queries to the compile observer. The
+// query rejected by the observer and the ones registered after it are rolled
+// back
+func (s *QueryStore) notifyObserver(registered []registration) error {
+	observe := s.opts.observer
+	if observe == nil {
+		return nil
+	}
+
+	for i, r := range registered {
+		q := r.query
+		if err := observe(q.Name, q.OrdinalQuery, q.Params()); err != nil {
+			s.unregister(registered[i:])
+			return fmt.Errorf("Query '%s': %w", q.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// unregister restores the definitions replaced by the registrations, unless
+// the queries were replaced again in the meantime
+func (s *QueryStore) unregister(registered []registration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := len(registered) - 1; i >= 0; i-- {
+		r := registered[i]
+		switch {
+		case s.queries[r.query.Name] != r.query:
+		case r.replaced != nil:
+			s.queries[r.query.Name] = r.replaced
+		default:
+			delete(s.queries, r.query.Name)
+			delete(s.uses, r.query.Name)
+		}
+	}
+}
+
+// intern returns the already stored copy of an identical query body, so the
+// queries share its backing storage
+func (s *QueryStore) intern(body string) string {
+	if shared, ok := s.interned[body]; ok {
+		return shared
+	}
+
+	if s.interned == nil {
+		s.interned = make(map[string]string)
+	}
+	s.interned[body] = body
+
+	return body
+}
+
+// readWithTimeout reads r to the end unless it takes longer than timeout
+func readWithTimeout(r io.Reader, timeout time.Duration) ([]byte, error) {
+	type result struct {
+		data []byte
+		err  error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		data, err := io.ReadAll(r)
+		done <- result{data, err}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case res := <-done:
+		return res.data, res.err
+	case <-timer.C:
+		return nil, fmt.Errorf("read timed out after %v", timeout)
+	}
+}
+
+// register inserts the query (but checks whatever it already exists)
+func (s *QueryStore) register(q *Query) error {
+	if existing, ok := s.queries[q.Name]; ok {
+		// a replacement keeps the position of the query it replaces
+		switch s.opts.duplicates {
+		case DuplicateOverride:
+			if !sameDefinition(existing, q) {
+				q.seq = existing.seq
+				s.queries[q.Name] = q
+			}
+		case DuplicateIgnore:
+			if !sameDefinition(existing, q) {
+				q.seq = existing.seq
+				s.queries[q.Name] = q
+				s.uses[q.Name] = new(int64)
+			}
+		default:
+			return fmt.Errorf("Query '%s' from %s %w in %s", q.Name, q.location(), ErrDuplicateQuery, existing.location())
+		}
+
+		return nil
+	}
+
+	if max := s.opts.maxQueries; max > 0 && len(s.queries) >= max {
+		return fmt.Errorf("Query '%s' exceeds the limit of %d queries", q.Name, max)
+	}
+
+	s.loaded++
+	q.seq = s.loaded
+	s.queries[q.Name] = q
+	s.uses[q.Name] = new(int64)
+
+	return nil
+}
+
+// WriteToFile writes all queries into a single file using `-- name:`
+// headers, so the file can be loaded back with LoadFromFile
+func (s *QueryStore) WriteToFile(path string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var buf strings.Builder
+
+	for i, name := range s.names() {
+		q := s.queries[name]
+
+		if i > 0 {
+			buf.WriteString("\n")
+		}
+		fmt.Fprintf(&buf, "-- name: %s\n", name)
+
+		keys := make([]string, 0, len(q.Metadata))
+		for key := range q.Metadata {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			fmt.Fprintf(&buf, "-- %s: %s\n", key, q.Metadata[key])
+		}
+
+		defaults := make([]string, 0, len(q.Defaults))
+		for key := range q.Defaults {
+			defaults = append(defaults, key)
+		}
+		sort.Strings(defaults)
+
+		for _, key := range defaults {
+			fmt.Fprintf(&buf, "-- default %s: %s\n", key, formatDefault(q.Defaults[key]))
+		}
+
+		buf.WriteString(q.Raw)
+		buf.WriteString("\n")
+	}
+
+	return os.WriteFile(path, []byte(buf.String()), 0o644)
+}
+
+// formatDefault writes the default value the way parseDefaults reads it back
+func formatDefault(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "NULL"
+	case string:
+		return "'" + strings.ReplaceAll(v, "'", "''") + "'"
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// QueriesBySource returns the sorted names of queries grouped by the file
+// they were loaded from
+func (s *QueryStore) QueriesBySource() map[string][]string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	sources := make(map[string][]string)
+	for _, name := range s.names() {
+		source := s.queries[name].Source
+		sources[source] = append(sources[source], name)
+	}
+
+	return sources
+}
+
+type (
+	paramUsage struct {
+		Param   string            `json:"param"`
+		Total   int               `json:"total"`
+		Queries []paramQueryUsage `json:"queries"`
+	}
+
+	paramQueryUsage struct {
+		Query       string `json:"query"`
+		Occurrences int    `json:"occurrences"`
+	}
+)
+
+// ParamUsageReport returns a JSON report listing for every parameter name
+// the queries using it and how many times, ordered by parameter and query
+// name
+func (s *QueryStore) ParamUsageReport() []byte {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	usage := make(map[string]*paramUsage)
+
+	for _, name := range s.names() {
+		q := s.queries[name]
+		for param, count := range q.paramOccurrences() {
+			u, ok := usage[param]
+			if !ok {
+				u = &paramUsage{Param: param}
+				usage[param] = u
+			}
+
+			u.Total += count
+			u.Queries = append(u.Queries, paramQueryUsage{Query: name, Occurrences: count})
+		}
+	}
+
+	report := make([]*paramUsage, 0, len(usage))
+	for _, u := range usage {
+		report = append(report, u)
+	}
+	sort.Slice(report, func(i, j int) bool {
+		return report[i].Param < report[j].Param
+	})
+
+	data, _ := json.MarshalIndent(report, "", "  ")
+
+	return data
+}
+
+// UnusedQueries returns sorted names of queries never retrieved via Query or
+// MustHaveQuery
+func (s *QueryStore) UnusedQueries() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var names []string
+	for _, name := range s.names() {
+		if atomic.LoadInt64(s.uses[name]) == 0 {
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+// expandMetadata replaces ${VAR} references in metadata values when variable
+// expansion is enabled
+func (s *QueryStore) expandMetadata(metadata map[string]string) (map[string]string, error) {
+	if s.opts.lookupVar == nil {
+		return metadata, nil
+	}
+
+	var err error
+
+	for key, value := range metadata {
+		metadata[key] = metadataVarRE.ReplaceAllStringFunc(value, func(ref string) string {
+			name := metadataVarRE.FindStringSubmatch(ref)[1]
+			expanded, ok := s.opts.lookupVar(name)
+			if !ok && s.opts.strictExpand && err == nil {
+				err = fmt.Errorf("Variable '%s' referenced by metadata '%s' is not set", name, key)
+			}
+			return expanded
+		})
+	}
+
+	return metadata, err
+}
+
+// NewQuery compiles the query, rewriting named parameters into ordinal
+// placeholders
+func NewQuery(name, query string, opts ...Option) *Query {
+	return newQuery(name, query, newOptions(opts))
+}
+
+func newQuery(name, query string, o *options) *Query {
+	q := &Query{
+		Name: name,
+		Raw:  query,
+		opts: o,
+	}
+
+	q.compile()
+
+	return q
+}
+
+// compilation is the result of rewriting the named parameters of Raw
+type compilation struct {
+	sql         string
+	mapping     map[string]int
+	layout      map[string][]int
+	params      []string
+	occurrences map[string]int
+}
+
+// compile rewrites the named parameters of Raw into ordinal placeholders
+// and fills the parameter mapping
+func (q *Query) compile() {
+	c := q.translate(func(placeholder, name string) string {
+		return placeholder
+	})
+
+	q.OrdinalQuery = fmt.Sprintf("-- %s\n%s", q.Name, c.sql)
+	q.Mapping = c.mapping
+	q.layout = c.layout
+	q.params = c.params
+	q.occurrences = c.occurrences
+}
+
+// translate rewrites the named parameters of Raw into the placeholders of
+// the query style, passed through decorate along with the parameter name
+func (q *Query) translate(decorate func(placeholder, name string) string) compilation {
+	var (
+		sql  strings.Builder
+		last int
+		opts = q.options()
+	)
+
+	c := compilation{
+		mapping:     make(map[string]int),
+		layout:      make(map[string][]int),
+		occurrences: make(map[string]int),
+	}
+
+	// question marks carry no ordinal, every occurrence needs its own argument
+	dialect := q.dialect()
+	expand := opts.expandRepeats || dialect.questionMarks()
+
+	for _, p := range scanParams(q.Raw, opts) {
+		if opts.normalize != nil {
+			p.name = opts.normalize(p.name)
+		}
+
+		c.occurrences[p.name]++
+
+		ord, ok := c.mapping[p.name]
+		if !ok || expand {
+			c.params = append(c.params, p.name)
+			ord = len(c.params)
+
+			if !ok {
+				c.mapping[p.name] = ord
+			}
+			c.layout[p.name] = append(c.layout[p.name], ord)
+		}
+
+		sql.WriteString(q.Raw[last:p.start])
+		sql.WriteString(decorate(dialect.placeholder(ord), p.name))
+		last = p.end
+	}
+	sql.WriteString(q.Raw[last:])
+
+	c.sql = unescapeColons(sql.String())
+
+	return c
+}
+
+// NullBound returns the ordinal query with every placeholder replaced by
+// NULL::unknown, e.g. to validate the query with PREPARE or EXPLAIN without
+// supplying arguments
+func (q *Query) NullBound() string {
+	c := q.translate(func(placeholder, name string) string {
+		return "NULL::unknown"
+	})
+
+	return fmt.Sprintf("-- %s\n%s", q.Name, c.sql)
+}
+
+// Annotated returns the ordinal query with each placeholder followed by
+// a comment naming its parameter, e.g. `$1 /* id */`
+func (q *Query) Annotated() string {
+	c := q.translate(func(placeholder, name string) string {
+		return fmt.Sprintf("%s /* %s */", placeholder, name)
+	})
+
+	return fmt.Sprintf("-- %s\n%s", q.Name, c.sql)
+}
+
+// Recompile regenerates OrdinalQuery and Mapping from the current Raw, e.g.
+// after appending a clause. When options are given they replace the ones the
+// query was compiled with
+func (q *Query) Recompile(opts ...Option) error {
+	if len(opts) > 0 {
+		q.opts = newOptions(opts)
+	}
+	q.opts = q.options()
+
+	q.compile()
+
+	return q.checkStrayOrdinals()
+}
+
+// Combine concatenates the raw queries with sep (e.g. "\nUNION ALL\n") and
+// compiles the result with the options, metadata and source of the first
+// query and the defaults of all of them. Parameters
+// shared by the queries are bound once, the ordinals are renumbered across
+// the combined query
+func Combine(sep string, queries ...*Query) (*Query, error) {
+	if len(queries) == 0 {
+		return nil, fmt.Errorf("No queries to combine")
+	}
+
+	var (
+		names    = make([]string, len(queries))
+		raws     = make([]string, len(queries))
+		defaults map[string]interface{}
+	)
+	for i, q := range queries {
+		names[i] = q.Name
+		raws[i] = q.Raw
+
+		for name, value := range q.Defaults {
+			if defaults == nil {
+				defaults = make(map[string]interface{})
+			}
+			if _, ok := defaults[name]; !ok {
+				defaults[name] = value
+			}
+		}
+	}
+
+	combined := &Query{
+		Name:     strings.Join(names, "+"),
+		Raw:      strings.Join(raws, sep),
+		Metadata: queries[0].Metadata,
+		Defaults: defaults,
+		Source:   queries[0].Source,
+		opts:     queries[0].options(),
+	}
+	combined.compile()
+
+	if err := combined.checkStrayOrdinals(); err != nil {
+		return nil, err
+	}
+
+	return combined, nil
+}
+
+// checkStrayOrdinals rejects queries mixing named parameters with literal
+// ordinal placeholders of the dialect ($N, @pN or :N), which would collide
+// with the generated ones, or with
+// bare ? placeholders, which leave the binding ambiguous. Literals and
+// comments are not checked
+func (q *Query) checkStrayOrdinals() error {
+	if len(q.Mapping) == 0 {
+		return nil
+	}
+
+	stray := numberedPlaceholders(q.Raw, q.dialect().ordinalPrefix())
+	for i := positionalMarks(q.Raw); i > 0; i-- {
+		stray = append(stray, "?")
+	}
+
+	if len(stray) > 0 {
+		return fmt.Errorf("Query '%s' mixes named parameters with positional placeholders %s", q.Name, strings.Join(stray, ", "))
+	}
+
+	return nil
+}
+
+// location returns the file and line the query was loaded from
+func (q *Query) location() string {
+	if q.SourceLine == 0 {
+		return q.Source
+	}
+
+	return fmt.Sprintf("%s:%d", q.Source, q.SourceLine)
+}
+
+// checkOrdinals verifies the mapping binds exactly the ordinals 1..N and
+// the ordinal query contains a placeholder for each of them, guarding
+// against a malformed compilation
+func (q *Query) checkOrdinals() error {
+	var (
+		n       = len(q.slotParams())
+		bound   = make([]bool, n+1)
+		dialect = q.dialect()
+	)
+
+	for name, first := range q.Mapping {
+		ords, ok := q.layout[name]
+		if !ok {
+			ords = []int{first}
+		}
+
+		for _, ord := range ords {
+			if ord < 1 || ord > n {
+				return fmt.Errorf("Query '%s' binds parameter '%s' to %s outside of the %d placeholders", q.Name, name, dialect.placeholder(ord), n)
+			}
+			bound[ord] = true
+		}
+	}
+
+	for ord := 1; ord <= n; ord++ {
+		if !bound[ord] {
+			return fmt.Errorf("Query '%s' binds no parameter to placeholder %d", q.Name, ord)
+		}
+	}
+
+	if dialect.questionMarks() {
+		if count := q.PlaceholderCount(); count != n {
+			return fmt.Errorf("Query '%s' has %d placeholders for %d parameters", q.Name, count, n)
+		}
+
+		return nil
+	}
+
+	found := make(map[string]bool)
+	for _, placeholder := range numberedPlaceholders(q.body(), dialect.ordinalPrefix()) {
+		found[placeholder] = true
+	}
+	for ord := 1; ord <= n; ord++ {
+		if placeholder := dialect.placeholder(ord); !found[placeholder] {
+			return fmt.Errorf("Query '%s' is missing placeholder %s", q.Name, placeholder)
+		}
+	}
+
+	return nil
+}
+
+// checkLength rejects compiled SQL longer than the configured maximum
+func (q *Query) checkLength(sql string) error {
+	if max := q.options().maxQueryLength; max > 0 && len(sql) > max {
+		return fmt.Errorf("Query '%s' is %d characters long, exceeding the limit of %d", q.Name, len(sql), max)
+	}
+
+	return nil
+}
+
+// UniqueParams returns the sorted names of parameters appearing exactly once
+// in the raw query
+func (q *Query) UniqueParams() []string {
+	return q.paramsOccurring(func(count int) bool { return count == 1 })
+}
+
+// ReusedParams returns the sorted names of parameters appearing more than
+// once in the raw query
+func (q *Query) ReusedParams() []string {
+	return q.paramsOccurring(func(count int) bool { return count > 1 })
+}
+
+func (q *Query) paramsOccurring(match func(count int) bool) []string {
+	names := []string{}
+	for name, count := range q.paramOccurrences() {
+		if match(count) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// paramOccurrences counts the appearances of each parameter in Raw
+func (q *Query) paramOccurrences() map[string]int {
+	if q.occurrences != nil {
+		return q.occurrences
+	}
+
+	// queries not compiled by NewQuery are scanned on demand
+	return q.translate(func(placeholder, name string) string {
+		return placeholder
+	}).occurrences
+}
+
+// param is an occurrence of a named parameter in the raw query
+type param struct {
+	name       string
+	start, end int
+}
+
+// scanParams finds all occurrences of named parameters in the query. String
+// literals, quoted identifiers, dollar quoted strings and comments are
+// skipped, as are :: casts and colons escaped as \:
+func scanParams(query string, o *options) []param {
+	var params []param
+
+	re := o.paramRegexp
+	if re == nil {
+		re = psqlVarRegexp
+	}
+
+	for i := 0; i < len(query); {
+		c := query[i]
+
+		switch {
+		case c == '\'' || c == '"':
+			i = skipQuoted(query, i, c)
+		case c == '$':
+			i = skipDollarQuoted(query, i)
+		case strings.HasPrefix(query[i:], "--"):
+			i = skipLineComment(query, i)
+		case strings.HasPrefix(query[i:], "/*"):
+			i = skipBlockComment(query, i)
+		case strings.HasPrefix(query[i:], "::"), strings.HasPrefix(query[i:], "\\:"):
+			i += 2
+		case c == ':':
+			match := re.FindStringSubmatchIndex(query[i:])
+			if match == nil {
+				i++
+				continue
+			}
+
+			name := query[i+match[2] : i+match[3]]
+			if !o.isReservedName(name) && (!strings.HasPrefix(name, "@") || autoParams[name] != nil) {
+				params = append(params, param{name: name, start: i, end: i + match[1]})
+			}
+			i += match[1]
+		default:
+			i++
+		}
+	}
+
+	return params
+}
+
+// Query returns ordinal query
+func (q *Query) Query() string {
+	return q.OrdinalQuery
+}
+
+// Explain returns the ordinal query prefixed with EXPLAIN (or EXPLAIN ANALYZE
+// when analyze is set). Queries already starting with EXPLAIN are returned
+// unchanged
+func (q *Query) Explain(analyze bool) string {
+	body := q.body()
+	if strings.EqualFold(firstKeyword(body), "EXPLAIN") {
+		return q.OrdinalQuery
+	}
+
+	prefix := "EXPLAIN"
+	if analyze {
+		prefix = "EXPLAIN ANALYZE"
+	}
+
+	return fmt.Sprintf("-- %s\n%s %s", q.Name, prefix, body)
+}
+
+// dialect returns the dialect whose placeholders the query is compiled to.
+// The `-- style:` metadata overrides the dialect of the store
+func (q *Query) dialect() Dialect {
+	switch q.Metadata["style"] {
+	case styleQuestion:
+		return MySQL
+	case styleDollar:
+		return Postgres
+	}
+
+	return q.options().dialect
+}
+
+// PrepareStatement returns the PostgreSQL PREPARE statement creating the
+// server-side prepared statement stmtName for the query. Parameter types are
+// taken from casts like :id::int and default to unknown
+func (q *Query) PrepareStatement(stmtName string) string {
+	params := q.slotParams()
+	if len(params) == 0 {
+		return fmt.Sprintf("-- %s\nPREPARE %s AS %s", q.Name, stmtName, q.body())
+	}
+
+	hints := q.typeHints()
+	types := make([]string, len(params))
+	for i, name := range params {
+		types[i] = "unknown"
+		if hint, ok := hints[name]; ok {
+			types[i] = hint
+		}
+	}
+
+	return fmt.Sprintf("-- %s\nPREPARE %s (%s) AS %s", q.Name, stmtName, strings.Join(types, ", "), q.body())
+}
+
+// typeHints returns the types parameters are cast to in the raw query, the
+// first cast of a parameter wins
+func (q *Query) typeHints() map[string]string {
+	opts := q.options()
+	hints := make(map[string]string)
+
+	for _, p := range scanParams(q.Raw, opts) {
+		if opts.normalize != nil {
+			p.name = opts.normalize(p.name)
+		}
+
+		rest := q.Raw[p.end:]
+		if _, ok := hints[p.name]; ok || !strings.HasPrefix(rest, "::") {
+			continue
+		}
+
+		end := 2
+		for end < len(rest) && (isWordChar(rest[end]) || rest[end] == '[' || rest[end] == ']') {
+			end++
+		}
+		if end > 2 {
+			hints[p.name] = rest[2:end]
+		}
+	}
+
+	return hints
+}
+
+// options returns the options the query was compiled with
+func (q *Query) options() *options {
+	if q.opts == nil {
+		return defaultOptions
+	}
+
+	return q.opts
+}
+
+// body returns the ordinal query without the leading name comment
+func (q *Query) body() string {
+	return strings.TrimPrefix(q.OrdinalQuery, fmt.Sprintf("-- %s\n", q.Name))
+}
+
+// Prepare the arguments for the ordinal query. Missing arguments take their
+// declared Defaults or will be returned as nil, except the automatic :@now
+// (current time) and :@uuid (random UUID) parameters which are generated
+// unless provided
+func (q *Query) Prepare(args map[string]interface{}) []interface{} {
+	components, _ := q.prepare(mapArgs(q.normalizeArgs(args)))
+
+	return components
+}
+
+// PrepareStrict prepares the arguments like Prepare, but fails when a
+// parameter has no argument (and is neither resolved nor automatic) or when
+// an argument is not used by the query. The error names the offending keys
+func (q *Query) PrepareStrict(args map[string]interface{}) ([]interface{}, error) {
+	args = q.normalizeArgs(args)
+
+	components, missing := q.prepare(mapArgs(args))
+
+	var unknown []string
+	for name := range args {
+		if _, ok := q.Mapping[name]; !ok {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+
+	var problems []string
+	if len(missing) > 0 {
+		problems = append(problems, "missing arguments "+strings.Join(missing, ", "))
+	}
+	if len(unknown) > 0 {
+		problems = append(problems, "unknown arguments "+strings.Join(unknown, ", "))
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("Query '%s': %s", q.Name, strings.Join(problems, "; "))
+	}
+
+	return components, nil
+}
+
+// PrepareExpanded prepares the arguments and renders the ordinal query for
+// them, expanding slice arguments into a placeholder per element, e.g. for
+// `id IN (:ids)` with three ids into `id IN ($1, $2, $3)`. An empty slice is
+// rendered as NULL, so `IN (NULL)` matches no rows. []byte and driver.Valuer
+// arguments are bound as single values
+func (q *Query) PrepareExpanded(args map[string]interface{}) (string, []interface{}, error) {
+	args = q.normalizeArgs(args)
+
+	var (
+		sql     strings.Builder
+		last    int
+		values  []interface{}
+		opts    = q.options()
+		dialect = q.dialect()
+		bound   = make(map[string]string)
+	)
+
+	for _, p := range scanParams(q.Raw, opts) {
+		if opts.normalize != nil {
+			p.name = opts.normalize(p.name)
+		}
+
+		placeholders, ok := bound[p.name]
+		if !ok || opts.expandRepeats || dialect.questionMarks() {
+			value, _ := q.lookupArgument(mapArgs(args), p.name)
+			if opts.derefPointers {
+				value = derefPointer(value)
+			}
+
+			items, isSlice := sliceItems(value)
+			if !isSlice {
+				items = []interface{}{value}
+			}
+
+			rendered := make([]string, len(items))
+			for i, item := range items {
+				if _, nested := sliceItems(item); nested {
+					return "", nil, fmt.Errorf("Query '%s': argument '%s' contains nested slices", q.Name, p.name)
+				}
+
+				values = append(values, item)
+				rendered[i] = dialect.placeholder(len(values))
+			}
+
+			placeholders = strings.Join(rendered, ", ")
+			if len(items) == 0 {
+				placeholders = "NULL"
+			}
+
+			if !ok {
+				bound[p.name] = placeholders
+			}
+		}
+
+		sql.WriteString(q.Raw[last:p.start])
+		sql.WriteString(placeholders)
+		last = p.end
+	}
+	sql.WriteString(q.Raw[last:])
+
+	expanded := unescapeColons(sql.String())
+	if err := q.checkLength(expanded); err != nil {
+		return "", nil, err
+	}
+
+	return fmt.Sprintf("-- %s\n%s", q.Name, expanded), values, nil
+}
+
+// Render returns the raw query with every parameter replaced by a literal of
+// its argument, e.g. to paste a logged query into psql. Strings are quoted
+// with inner quotes doubled, numbers and booleans are bare and nil is NULL.
+// Render is meant for logging and debugging only: the quoting is not
+// guaranteed to be safe, NEVER send the rendered query to the database
+func (q *Query) Render(args map[string]interface{}) (string, error) {
+	var (
+		sql  strings.Builder
+		last int
+		get  = mapArgs(q.normalizeArgs(args))
+		opts = q.options()
+	)
+
+	for _, p := range scanParams(q.Raw, opts) {
+		if opts.normalize != nil {
+			p.name = opts.normalize(p.name)
+		}
+
+		value, _ := q.lookupArgument(get, p.name)
+		literal, err := renderLiteral(value)
+		if err != nil {
+			return "", fmt.Errorf("Query '%s': argument '%s' %v", q.Name, p.name, err)
+		}
+
+		sql.WriteString(q.Raw[last:p.start])
+		sql.WriteString(literal)
+		last = p.end
+	}
+	sql.WriteString(q.Raw[last:])
+
+	return fmt.Sprintf("-- %s\n%s", q.Name, unescapeColons(sql.String())), nil
+}
+
+// renderLiteral formats the value as a SQL literal for Render
+func renderLiteral(value interface{}) (string, error) {
+	value = derefPointer(value)
+	if valuer, ok := value.(driver.Valuer); ok {
+		v, err := valuer.Value()
+		if err != nil {
+			return "", err
+		}
+		value = v
+	}
+
+	switch v := value.(type) {
+	case nil:
+		return "NULL", nil
+	case string:
+		return "'" + strings.ReplaceAll(v, "'", "''") + "'", nil
+	case []byte:
+		return fmt.Sprintf("'\\x%x'", v), nil
+	case bool:
+		if v {
+			return "TRUE", nil
+		}
+		return "FALSE", nil
+	case time.Time:
+		return "'" + v.Format(time.RFC3339Nano) + "'", nil
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return fmt.Sprint(v), nil
+	}
+
+	return "", fmt.Errorf("of type %T cannot be rendered", value)
+}
+
+// sliceItems returns the elements of a slice or array argument
+func sliceItems(value interface{}) ([]interface{}, bool) {
+	switch value.(type) {
+	case []byte, driver.Valuer:
+		return nil, false
+	}
+
+	v := reflect.ValueOf(value)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return nil, false
+	}
+
+	items := make([]interface{}, v.Len())
+	for i := range items {
+		items[i] = v.Index(i).Interface()
+	}
+
+	return items, true
+}
+
+// PrepareFunc prepares the arguments like Prepare, taking them from get
+// called with each parameter name in ordinal order, e.g. to bind from a
+// sync.Map. It fails naming the parameters get has no value for, unless
+// they are resolved or automatic
+func (q *Query) PrepareFunc(get func(name string) (interface{}, bool)) ([]interface{}, error) {
+	components, missing := q.prepare(get)
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("Query '%s': missing arguments %s", q.Name, strings.Join(missing, ", "))
+	}
+
+	return components, nil
+}
+
+// mapArgs returns the lookup of the arguments in args
+func mapArgs(args map[string]interface{}) func(name string) (interface{}, bool) {
+	return func(name string) (interface{}, bool) {
+		value, ok := args[name]
+		return value, ok
+	}
+}
+
+// prepare binds the arguments returned by get to the ordinal placeholders
+// and returns the parameters left without a value, in placeholder order
+func (q *Query) prepare(get func(name string) (interface{}, bool)) ([]interface{}, []string) {
+	var (
+		params  = q.slotParams()
+		missing []string
+		seen    = make(map[string]bool)
+	)
+
+	components := make([]interface{}, len(params))
+	for i, name := range params {
+		value, ok := q.lookupArgument(get, name)
+		if !ok && !seen[name] {
+			missing = append(missing, name)
+		}
+		seen[name] = true
+
+		components[i] = value
+		if q.options().derefPointers {
+			components[i] = derefPointer(components[i])
+		}
+	}
+
+	if q.options().debugChecks {
+		if count := q.PlaceholderCount(); count != len(components) {
+			panic(fmt.Sprintf("Query '%s' prepared %d arguments for %d placeholders", q.Name, len(components), count))
+		}
+	}
+
+	return components, missing
+}
+
+// LogFields returns fields describing the query execution for a structured
+// logger: the query name, the ordinal SQL, the parameter of each placeholder
+// and the supplied arguments with their values redacted
+func (q *Query) LogFields(args map[string]interface{}) map[string]interface{} {
+	args = q.normalizeArgs(args)
+
+	redacted := make(map[string]string)
+	for name := range args {
+		if _, ok := q.Mapping[name]; ok {
+			redacted[name] = redactedValue
+		}
+	}
+
+	return map[string]interface{}{
+		"query":  q.Name,
+		"sql":    q.OrdinalQuery,
+		"params": append([]string(nil), q.slotParams()...),
+		"args":   redacted,
+	}
+}
+
+// Params returns the parameter names in ordinal order, index 0 is bound to
+// $1. With repeats expanded a name appears once per placeholder
+func (q *Query) Params() []string {
+	return append([]string{}, q.slotParams()...)
+}
+
+// slotParams returns the parameter name of each ordinal placeholder
+func (q *Query) slotParams() []string {
+	if q.params != nil {
+		return q.params
+	}
+
+	// queries not compiled by NewQuery only carry the mapping
+	params := make([]string, 0, len(q.Mapping))
+	for name := range q.Mapping {
+		params = append(params, name)
+	}
+
+	sort.Slice(params, func(i, j int) bool {
+		return q.Mapping[params[i]] < q.Mapping[params[j]]
+	})
+
+	return params
+}
+
+// normalizeArgs applies the parameter name normalization to the argument
+// names, and renames arguments matching a parameter case-insensitively to
+// the parameter name when enabled. Arguments are not renamed when several of
+// them match the same parameter
+func (q *Query) normalizeArgs(args map[string]interface{}) map[string]interface{} {
+	opts := q.options()
+	if opts.normalize != nil {
+		normalized := make(map[string]interface{}, len(args))
+		for name, value := range args {
+			normalized[opts.normalize(name)] = value
+		}
+		args = normalized
+	}
+
+	if !opts.caseInsensitiveArgs {
+		return args
+	}
+
+	folded := make(map[string]interface{}, len(args))
+	for arg, value := range args {
+		folded[arg] = value
+	}
+
+	for name := range q.Mapping {
+		if _, exact := args[name]; exact {
+			continue
+		}
+
+		var matches []string
+		for arg := range args {
+			if strings.EqualFold(arg, name) {
+				matches = append(matches, arg)
+			}
+		}
+
+		// colliding spellings are left as they are, the parameter is
+		// missing and the arguments unknown
+		if len(matches) == 1 {
+			delete(folded, matches[0])
+			folded[name] = args[matches[0]]
+		}
+	}
+
+	return folded
+}
+
+// checkCaseAmbiguity rejects parameters differing only in case, which
+// case-insensitive arguments cannot tell apart
+func (q *Query) checkCaseAmbiguity() error {
+	params := q.Params()
+	for i, name := range params {
+		for _, other := range params[i+1:] {
+			if name != other && strings.EqualFold(name, other) {
+				return fmt.Errorf("Query '%s' has parameters '%s' and '%s' differing only in case", q.Name, name, other)
+			}
+		}
+	}
+
+	return nil
+}
+
+// lookupArgument returns the value bound to the parameter, reporting whether
+// it came from the arguments, the defaults, a resolver or the automatic
+// parameters
+func (q *Query) lookupArgument(get func(name string) (interface{}, bool), name string) (interface{}, bool) {
+	if value, ok := get(name); ok {
+		return value, true
+	}
+
+	if value, ok := q.Defaults[name]; ok {
+		return value, true
+	}
+
+	for _, resolve := range q.options().resolvers {
+		if value, ok := resolve(name); ok {
+			return value, true
+		}
+	}
+
+	if auto, ok := autoParams[name]; ok {
+		return auto(), true
+	}
+
+	return nil, false
+}
+
+// derefPointer follows pointers to the value they reference, returning nil
+// for a nil pointer at any level
+func derefPointer(value interface{}) interface{} {
+	for {
+		if _, ok := value.(driver.Valuer); ok {
+			return value
+		}
+
+		v := reflect.ValueOf(value)
+		if v.Kind() != reflect.Ptr {
+			return value
+		}
+		if v.IsNil() {
+			return nil
+		}
+
+		value = v.Elem().Interface()
+	}
+}
+
+// PlaceholderCount returns the number of distinct $N placeholders (@pN for
+// SQL Server, :N for Oracle) outside of literals and comments of the ordinal
+// query. For a correctly compiled query it equals len(Mapping). For queries
+// compiled with ? placeholders it returns the number of generated
+// placeholders
+func (q *Query) PlaceholderCount() int {
+	dialect := q.dialect()
+	if dialect.questionMarks() {
+		return strings.Count(q.body(), "?") - strings.Count(q.Raw, "?")
+	}
+
+	distinct := make(map[string]bool)
+	for _, placeholder := range numberedPlaceholders(q.body(), dialect.ordinalPrefix()) {
+		distinct[placeholder] = true
+	}
+
+	return len(distinct)
+}
+
+// PrepareWithLayout prepares the arguments like Prepare and also returns the
+// ordinal positions consumed by each parameter. Parameters have more than one
+// position only when repeats are expanded
+func (q *Query) PrepareWithLayout(args map[string]interface{}) ([]interface{}, map[string][]int) {
+	layout := make(map[string][]int, len(q.layout))
+	for name, ords := range q.layout {
+		layout[name] = append([]int(nil), ords...)
+	}
+
+	return q.Prepare(args), layout
+}
+
+// sameDefinition reports whether both queries were defined with the same SQL
+// and metadata
+func sameDefinition(a, b *Query) bool {
+	return a.Raw == b.Raw && reflect.DeepEqual(a.Metadata, b.Metadata) && reflect.DeepEqual(a.Defaults, b.Defaults)
+}
+
+// parseTransaction reads the `-- tx:` metadata flag
+func parseTransaction(metadata map[string]string) (bool, error) {
+	value, ok := metadata["tx"]
+	if !ok {
+		return false, nil
+	}
+
+	tx, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid tx metadata '%s'", value)
+	}
+
+	return tx, nil
+}
+
+// parseResultColumns reads the `-- returns:` metadata, a comma separated list
+// of column names optionally followed by their type
+func parseResultColumns(metadata map[string]string) ([]ResultColumn, error) {
+	value, ok := metadata["returns"]
+	if !ok {
+		return nil, nil
+	}
+
+	var columns []ResultColumn
+	for _, part := range splitOutsideParens(value) {
+		fields := strings.Fields(part)
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("invalid returns metadata '%s'", value)
+		}
+
+		columns = append(columns, ResultColumn{
+			Name: fields[0],
+			Type: strings.Join(fields[1:], " "),
+		})
+	}
+
+	return columns, nil
+}
+
+// parseDefaults converts the declared default values: NULL is nil, integers
+// are int64 and quoted values are unquoted strings. Any other value is taken
+// as a string verbatim
+func parseDefaults(declared map[string]string, normalize func(name string) string) map[string]interface{} {
+	if len(declared) == 0 {
+		return nil
+	}
+
+	defaults := make(map[string]interface{}, len(declared))
+	for name, value := range declared {
+		if normalize != nil {
+			name = normalize(name)
+		}
+
+		switch {
+		case strings.EqualFold(value, "null"):
+			defaults[name] = nil
+		case len(value) >= 2 && (value[0] == '\'' || value[0] == '"') && value[len(value)-1] == value[0]:
+			quote := string(value[0])
+			defaults[name] = strings.ReplaceAll(value[1:len(value)-1], quote+quote, quote)
+		default:
+			if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+				defaults[name] = n
+			} else {
+				defaults[name] = value
+			}
+		}
+	}
+
+	return defaults
+}
+
+// splitOutsideParens splits s at commas which are not enclosed in
+// parentheses, e.g. keeping numeric(10, 2) together
+func splitOutsideParens(s string) []string {
+	var (
+		parts []string
+		depth int
+		start int
+	)
+
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+
+	return append(parts, s[start:])
+}
+
+func isPlaceholderStyle(style string) bool {
+	return style == styleDollar || style == styleQuestion
+}
+
+func isReservedName(name string) bool {
+	return containsName(reservedNames, name, false)
+}
+
+// isReservedName reports whether the name is one of the configured reserved
+// names, which are never treated as parameters
+func (o *options) isReservedName(name string) bool {
+	reserved := o.reservedNames
+	if reserved == nil {
+		reserved = reservedNames
+	}
+
+	return containsName(reserved, name, o.reservedIgnoreCase)
+}
+
+func containsName(names []string, name string, ignoreCase bool) bool {
+	for _, n := range names {
+		if n == name || ignoreCase && strings.EqualFold(n, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// firstKeyword returns the first word of the statement, skipping leading
+// whitespace and comments
+func firstKeyword(sql string) string {
+	for {
+		sql = strings.TrimLeft(sql, " \t\r\n")
+		switch {
+		case strings.HasPrefix(sql, "--"):
+			end := strings.IndexByte(sql, '\n')
+			if end < 0 {
+				return ""
+			}
+			sql = sql[end+1:]
+		case strings.HasPrefix(sql, "/*"):
+			end := strings.Index(sql, "*/")
+			if end < 0 {
+				return ""
+			}
+			sql = sql[end+2:]
+		default:
+			end := strings.IndexFunc(sql, func(r rune) bool {
+				return !(r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9')
+			})
+			if end < 0 {
+				return sql
+			}
+			return sql[:end]
+		}
+	}
+}
+
+// newUUID returns a random (version 4) UUID
+func newUUID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
 }
@@ -1,10 +1,31 @@
 package queries
 
 import (
+	"archive/zip"
+	"bytes"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
 	"reflect"
+	"regexp"
+	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
+	"time"
+	"unsafe"
 )
 
+//go:embed testdata/embed
+var embedFS embed.FS
+
+//go:embed testdata/billing
+var billingFS embed.FS
+
 func TestIsReservedName(t *testing.T) {
 	testCases := []struct {
 		name     string
@@ -53,12 +74,93 @@ func TestNewQuery(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			q := NewQuery(tc.inputQuery)
+			q := NewQuery(tc.name, tc.inputQuery)
 			if q.Raw != tc.expectedRaw {
 				t.Errorf("Raw: got %s, expected %s", q.Raw, tc.expectedRaw)
 			}
-			if q.OrdinalQuery != tc.expectedOrd {
-				t.Errorf("OrdinalQuery: got %s, expected %s", q.OrdinalQuery, tc.expectedOrd)
+			if expected := "-- " + tc.name + "\n" + tc.expectedOrd; q.OrdinalQuery != expected {
+				t.Errorf("OrdinalQuery: got %s, expected %s", q.OrdinalQuery, expected)
+			}
+			if !reflect.DeepEqual(q.Mapping, tc.expectedMap) {
+				t.Errorf("Mapping: got %v, expected %v", q.Mapping, tc.expectedMap)
+			}
+		})
+	}
+}
+
+func TestExplain(t *testing.T) {
+	testCases := []struct {
+		name     string
+		query    string
+		analyze  bool
+		expected string
+	}{
+		{
+			name:     "plain",
+			query:    "SELECT * FROM users WHERE id = :id",
+			expected: "-- plain\nEXPLAIN SELECT * FROM users WHERE id = $1",
+		},
+		{
+			name:     "analyze",
+			query:    "SELECT * FROM users WHERE id = :id",
+			analyze:  true,
+			expected: "-- analyze\nEXPLAIN ANALYZE SELECT * FROM users WHERE id = $1",
+		},
+		{
+			name:     "already-explained",
+			query:    "explain SELECT * FROM users WHERE id = :id",
+			analyze:  true,
+			expected: "-- already-explained\nexplain SELECT * FROM users WHERE id = $1",
+		},
+		{
+			name:     "already-explained-after-comment",
+			query:    "/* debug */ EXPLAIN (ANALYZE) SELECT 1",
+			expected: "-- already-explained-after-comment\n/* debug */ EXPLAIN (ANALYZE) SELECT 1",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			q := NewQuery(tc.name, tc.query)
+			if got := q.Explain(tc.analyze); got != tc.expected {
+				t.Errorf("Explain(%v) = %q; expected %q", tc.analyze, got, tc.expected)
+			}
+		})
+	}
+}
+
+func TestNewQueryStatementTypes(t *testing.T) {
+	testCases := []struct {
+		name        string
+		inputQuery  string
+		expectedOrd string
+		expectedMap map[string]int
+	}{
+		{
+			name:        "call",
+			inputQuery:  "CALL do_thing(:a, :b)",
+			expectedOrd: "CALL do_thing($1, $2)",
+			expectedMap: map[string]int{"a": 1, "b": 2},
+		},
+		{
+			name:        "call-with-cast",
+			inputQuery:  "CALL archive_user(:user_id::bigint, :reason)",
+			expectedOrd: "CALL archive_user($1::bigint, $2)",
+			expectedMap: map[string]int{"user_id": 1, "reason": 2},
+		},
+		{
+			name:        "copy",
+			inputQuery:  "COPY (SELECT * FROM events WHERE created_at > :since) TO STDOUT WITH (FORMAT csv, DELIMITER :delim)",
+			expectedOrd: "COPY (SELECT * FROM events WHERE created_at > $1) TO STDOUT WITH (FORMAT csv, DELIMITER $2)",
+			expectedMap: map[string]int{"since": 1, "delim": 2},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			q := NewQuery(tc.name, tc.inputQuery)
+			if expected := "-- " + tc.name + "\n" + tc.expectedOrd; q.OrdinalQuery != expected {
+				t.Errorf("OrdinalQuery: got %s, expected %s", q.OrdinalQuery, expected)
 			}
 			if !reflect.DeepEqual(q.Mapping, tc.expectedMap) {
 				t.Errorf("Mapping: got %v, expected %v", q.Mapping, tc.expectedMap)
@@ -66,3 +168,2564 @@ func TestNewQuery(t *testing.T) {
 		})
 	}
 }
+
+func TestMetadataExpansion(t *testing.T) {
+	input := `-- name: get-user
+-- schema: ${APP_SCHEMA}
+-- table: ${APP_SCHEMA}.${APP_TABLE}
+SELECT * FROM users WHERE id = :id`
+
+	testCases := []struct {
+		name        string
+		opts        []Option
+		expected    map[string]string
+		expectedErr bool
+	}{
+		{
+			name:     "disabled",
+			expected: map[string]string{"schema": "${APP_SCHEMA}", "table": "${APP_SCHEMA}.${APP_TABLE}"},
+		},
+		{
+			name:     "unset-expands-empty",
+			opts:     []Option{WithVarExpansion(map[string]string{"APP_SCHEMA": "app"})},
+			expected: map[string]string{"schema": "app", "table": "app."},
+		},
+		{
+			name:        "unset-strict",
+			opts:        []Option{WithVarExpansion(map[string]string{"APP_SCHEMA": "app"}), WithStrictExpansion()},
+			expectedErr: true,
+		},
+		{
+			name:     "env",
+			opts:     []Option{WithEnvExpansion(), WithStrictExpansion()},
+			expected: map[string]string{"schema": "env_app", "table": "env_app.users"},
+		},
+	}
+
+	t.Setenv("APP_SCHEMA", "env_app")
+	t.Setenv("APP_TABLE", "users")
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := NewQueryStore(tc.opts...)
+			err := store.loadQueriesFromFile("users.sql", strings.NewReader(input))
+			if tc.expectedErr {
+				if err == nil {
+					t.Fatal("expected error for unset variable")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+
+			q := store.MustHaveQuery("get-user")
+			if !reflect.DeepEqual(q.Metadata, tc.expected) {
+				t.Errorf("Metadata: got %v, expected %v", q.Metadata, tc.expected)
+			}
+			if q.Raw != "SELECT * FROM users WHERE id = :id" {
+				t.Errorf("Raw: got %s", q.Raw)
+			}
+		})
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	store := NewQueryStore()
+	err := store.loadQueriesFromFile("users.sql", strings.NewReader("-- name: get-user\nSELECT * FROM users WHERE id = :id"))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	reader := store.ReadOnly()
+
+	if _, ok := reader.(*QueryStore); ok {
+		t.Fatal("ReadOnly returned the mutable store")
+	}
+	if _, ok := reader.(interface{ LoadFromFile(string) error }); ok {
+		t.Fatal("ReadOnly exposes loaders")
+	}
+
+	err = store.loadQueriesFromFile("orders.sql", strings.NewReader("-- name: get-order\nSELECT * FROM orders WHERE id = :id"))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if !reader.Has("get-user") {
+		t.Error("Has(get-user) = false; expected true")
+	}
+	if reader.Has("get-order") {
+		t.Error("snapshot sees query loaded after it was taken")
+	}
+	if names := reader.Names(); !reflect.DeepEqual(names, []string{"get-user"}) {
+		t.Errorf("Names() = %v; expected [get-user]", names)
+	}
+	if _, err := reader.Query("get-order"); err == nil {
+		t.Error("Query(get-order): expected error")
+	}
+	if names := store.Names(); !reflect.DeepEqual(names, []string{"get-order", "get-user"}) {
+		t.Errorf("store Names() = %v", names)
+	}
+}
+
+func TestNamespace(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"users/get_by_id.sql":   "SELECT * FROM users WHERE id = :id",
+		"billing/get_by_id.sql": "SELECT * FROM invoices WHERE id = :id",
+		"billing/admin/all.sql": "SELECT * FROM invoices",
+	} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, opts := range [][]Option{{WithPathNames("/")}, {WithDirNamespacing()}} {
+		store := NewQueryStore(opts...)
+		if err := store.LoadFromDir(dir); err != nil {
+			t.Fatalf("LoadFromDir: unexpected error %v", err)
+		}
+		sep := "."
+		if store.opts.pathSeparator == "/" {
+			sep = "/"
+		}
+
+		billing := store.Namespace("billing")
+		q, err := billing.Query("get_by_id")
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if !strings.Contains(q.Raw, "invoices") {
+			t.Errorf("expected the billing query, got %q", q.Raw)
+		}
+		if names := billing.Names(); !reflect.DeepEqual(names, []string{"admin" + sep + "all", "get_by_id"}) {
+			t.Errorf("Names() = %v", names)
+		}
+		if !store.Namespace("billing" + sep + "admin").Has("all") {
+			t.Error("nested namespace lookup failed")
+		}
+		if store.Namespace("users").Has("all") {
+			t.Error("query found outside of its namespace")
+		}
+	}
+}
+
+func TestExpandRepeats(t *testing.T) {
+	query := "SELECT * FROM users WHERE id = :id OR parent_id = :id AND name = :name"
+	args := map[string]interface{}{"id": 7, "name": "john"}
+
+	testCases := []struct {
+		name           string
+		opts           []Option
+		expectedOrd    string
+		expectedArgs   []interface{}
+		expectedLayout map[string][]int
+	}{
+		{
+			name:           "shared",
+			expectedOrd:    "SELECT * FROM users WHERE id = $1 OR parent_id = $1 AND name = $2",
+			expectedArgs:   []interface{}{7, "john"},
+			expectedLayout: map[string][]int{"id": {1}, "name": {2}},
+		},
+		{
+			name:           "expanded",
+			opts:           []Option{WithExpandRepeats()},
+			expectedOrd:    "SELECT * FROM users WHERE id = $1 OR parent_id = $2 AND name = $3",
+			expectedArgs:   []interface{}{7, 7, "john"},
+			expectedLayout: map[string][]int{"id": {1, 2}, "name": {3}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			q := NewQuery(tc.name, query, tc.opts...)
+			if expected := "-- " + tc.name + "\n" + tc.expectedOrd; q.OrdinalQuery != expected {
+				t.Errorf("OrdinalQuery: got %s, expected %s", q.OrdinalQuery, expected)
+			}
+			if !reflect.DeepEqual(q.Mapping, map[string]int{"id": 1, "name": tc.expectedLayout["name"][0]}) {
+				t.Errorf("Mapping: got %v", q.Mapping)
+			}
+
+			prepared, layout := q.PrepareWithLayout(args)
+			if !reflect.DeepEqual(prepared, tc.expectedArgs) {
+				t.Errorf("args: got %v, expected %v", prepared, tc.expectedArgs)
+			}
+			if !reflect.DeepEqual(layout, tc.expectedLayout) {
+				t.Errorf("layout: got %v, expected %v", layout, tc.expectedLayout)
+			}
+		})
+	}
+}
+
+func TestLoadFromEmbedPathNames(t *testing.T) {
+	testCases := []struct {
+		name     string
+		opts     []Option
+		expected []string
+	}{
+		{
+			name:     "base-names",
+			expected: []string{"count", "get", "list-admins", "top"},
+		},
+		{
+			name:     "slash",
+			opts:     []Option{WithPathNames("/")},
+			expected: []string{"list-admins", "top", "users/admin/count", "users/get"},
+		},
+		{
+			name:     "dot",
+			opts:     []Option{WithPathNames(".")},
+			expected: []string{"list-admins", "top", "users.admin.count", "users.get"},
+		},
+		{
+			name:     "namespaced",
+			opts:     []Option{WithDirNamespacing()},
+			expected: []string{"top", "users.admin.count", "users.admin.list-admins", "users.get"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := NewQueryStore(tc.opts...)
+			if err := store.LoadFromEmbed(embedFS, "testdata/embed/"); err != nil {
+				t.Fatalf("LoadFromEmbed: unexpected error %v", err)
+			}
+			if names := store.Names(); !reflect.DeepEqual(names, tc.expected) {
+				t.Errorf("Names() = %v; expected %v", names, tc.expected)
+			}
+		})
+	}
+}
+
+func TestLoadFromDirPathNames(t *testing.T) {
+	store := NewQueryStore(WithPathNames("."))
+	if err := store.LoadFromDir("testdata/embed"); err != nil {
+		t.Fatalf("LoadFromDir: unexpected error %v", err)
+	}
+
+	expected := []string{"list-admins", "top", "users.admin.count", "users.get"}
+	if names := store.Names(); !reflect.DeepEqual(names, expected) {
+		t.Errorf("Names() = %v; expected %v", names, expected)
+	}
+}
+
+func TestPrepareWithoutCompiledParams(t *testing.T) {
+	q := NewQuery("get-user", "SELECT * FROM users WHERE id = :id AND name = :name AND id <> :other")
+	args := map[string]interface{}{"id": 1, "name": "john", "other": 2}
+
+	manual := &Query{Name: q.Name, Raw: q.Raw, OrdinalQuery: q.OrdinalQuery, Mapping: q.Mapping}
+
+	if got, expected := q.Prepare(args), manual.Prepare(args); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Prepare: got %v, expected %v", got, expected)
+	}
+}
+
+func TestPrepareAllocations(t *testing.T) {
+	q := NewQuery("search", "SELECT * FROM users WHERE a = :a AND b = :b AND a <> :c")
+	args := map[string]interface{}{"a": 1, "b": 2, "c": 3}
+
+	// only the argument slice is allocated, the ordinal order is precomputed
+	if allocs := testing.AllocsPerRun(100, func() { q.Prepare(args) }); allocs > 1 {
+		t.Errorf("Prepare allocated %v times per call, expected 1", allocs)
+	}
+}
+
+func BenchmarkPrepare(b *testing.B) {
+	q := NewQuery("search", "SELECT * FROM users WHERE a = :a AND b = :b AND c = :c AND d = :d AND e = :e AND f = :f")
+	args := map[string]interface{}{"a": 1, "b": 2, "c": 3, "d": 4, "e": 5, "f": 6}
+
+	b.Run("precomputed", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			q.Prepare(args)
+		}
+	})
+
+	b.Run("sorted", func(b *testing.B) {
+		manual := &Query{Name: q.Name, OrdinalQuery: q.OrdinalQuery, Mapping: q.Mapping}
+
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			manual.Prepare(args)
+		}
+	})
+}
+
+func TestUnusedQueries(t *testing.T) {
+	store := NewQueryStore()
+	input := `-- name: get-user
+SELECT * FROM users WHERE id = :id
+
+-- name: list-users
+SELECT * FROM users
+
+-- name: delete-user
+DELETE FROM users WHERE id = :id`
+
+	if err := store.loadQueriesFromFile("users.sql", strings.NewReader(input)); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	store.MustHaveQuery("get-user")
+	store.MustHaveQuery("get-user")
+	if _, err := store.ReadOnly().Query("list-users"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := store.Query("missing"); err == nil {
+		t.Fatal("expected error for missing query")
+	}
+
+	if unused := store.UnusedQueries(); !reflect.DeepEqual(unused, []string{"delete-user"}) {
+		t.Errorf("UnusedQueries() = %v; expected [delete-user]", unused)
+	}
+}
+
+func TestLoadFromDirSymlinks(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "sql")
+	shared := filepath.Join(dir, "shared")
+
+	for path, content := range map[string]string{
+		filepath.Join(root, "users.sql"):    "-- name: get-user\nSELECT * FROM users WHERE id = :id",
+		filepath.Join(shared, "common.sql"): "-- name: get-setting\nSELECT value FROM settings WHERE key = :key",
+	} {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := os.Symlink(shared, filepath.Join(root, "shared")); err != nil {
+		t.Skipf("symlinks not supported: %v", err)
+	}
+	// a loop back to the root must not be walked again
+	if err := os.Symlink(root, filepath.Join(root, "loop")); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name     string
+		opts     []Option
+		expected []string
+	}{
+		{name: "default", expected: []string{"get-user"}},
+		{name: "follow", opts: []Option{WithFollowSymlinks()}, expected: []string{"get-setting", "get-user"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := NewQueryStore(tc.opts...)
+			if err := store.LoadFromDir(root); err != nil {
+				t.Fatalf("LoadFromDir: unexpected error %v", err)
+			}
+			if names := store.Names(); !reflect.DeepEqual(names, tc.expected) {
+				t.Errorf("Names() = %v; expected %v", names, tc.expected)
+			}
+		})
+	}
+}
+
+func TestWriteToFile(t *testing.T) {
+	input := `-- name: get-user
+-- schema: app
+SELECT *
+FROM users
+WHERE id = :id
+
+-- name: list-users
+-- default limit: 50
+-- default status: 'it''s 42'
+-- default team: NULL
+SELECT * FROM users WHERE status = :status AND team = :team LIMIT :limit`
+
+	store := NewQueryStore()
+	if err := store.loadQueriesFromFile("users.sql", strings.NewReader(input)); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "all.sql")
+	if err := store.WriteToFile(path); err != nil {
+		t.Fatalf("WriteToFile: unexpected error %v", err)
+	}
+
+	reloaded := NewQueryStore()
+	if err := reloaded.LoadFromFile(path); err != nil {
+		t.Fatalf("LoadFromFile: unexpected error %v", err)
+	}
+
+	if !reflect.DeepEqual(reloaded.Names(), store.Names()) {
+		t.Fatalf("Names() = %v; expected %v", reloaded.Names(), store.Names())
+	}
+	for _, name := range store.Names() {
+		expected, got := store.MustHaveQuery(name), reloaded.MustHaveQuery(name)
+		if got.Raw != expected.Raw || got.OrdinalQuery != expected.OrdinalQuery {
+			t.Errorf("%s: got %q, expected %q", name, got.Raw, expected.Raw)
+		}
+		if !reflect.DeepEqual(got.Mapping, expected.Mapping) || !reflect.DeepEqual(got.Metadata, expected.Metadata) {
+			t.Errorf("%s: got %v %v, expected %v %v", name, got.Mapping, got.Metadata, expected.Mapping, expected.Metadata)
+		}
+		if !reflect.DeepEqual(got.Defaults, expected.Defaults) {
+			t.Errorf("%s: got defaults %v, expected %v", name, got.Defaults, expected.Defaults)
+		}
+	}
+
+	expected := map[string]interface{}{"limit": int64(50), "status": "it's 42", "team": nil}
+	if got := reloaded.MustHaveQuery("list-users").Defaults; !reflect.DeepEqual(got, expected) {
+		t.Errorf("got defaults %v, expected %v", got, expected)
+	}
+}
+
+func TestAutoParams(t *testing.T) {
+	q := NewQuery("insert-event", "INSERT INTO events (id, name, created_at) VALUES (:@uuid, :name, :@now) RETURNING :@unknown")
+
+	expectedMap := map[string]int{"@uuid": 1, "name": 2, "@now": 3}
+	if !reflect.DeepEqual(q.Mapping, expectedMap) {
+		t.Fatalf("Mapping: got %v, expected %v", q.Mapping, expectedMap)
+	}
+
+	t.Run("auto-fill", func(t *testing.T) {
+		before := time.Now()
+		args := q.Prepare(map[string]interface{}{"name": "signup"})
+
+		id, ok := args[0].(string)
+		if !ok || !regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(id) {
+			t.Errorf("@uuid: got %v", args[0])
+		}
+		if args[1] != "signup" {
+			t.Errorf("name: got %v", args[1])
+		}
+		if now, ok := args[2].(time.Time); !ok || now.Before(before) {
+			t.Errorf("@now: got %v", args[2])
+		}
+	})
+
+	t.Run("override", func(t *testing.T) {
+		at := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		args := q.Prepare(map[string]interface{}{"name": "signup", "@now": at, "@uuid": "fixed"})
+
+		expected := []interface{}{"fixed", "signup", at}
+		if !reflect.DeepEqual(args, expected) {
+			t.Errorf("Prepare: got %v, expected %v", args, expected)
+		}
+	})
+}
+
+func TestCheckOrdinals(t *testing.T) {
+	for _, dialect := range []Dialect{Postgres, MySQL, SQLServer, Oracle} {
+		q := NewQuery("ok", "SELECT * FROM t WHERE a = :a AND b = :b AND a <> :a", WithDialect(dialect))
+		if err := q.checkOrdinals(); err != nil {
+			t.Errorf("%s: unexpected error %v", dialect, err)
+		}
+	}
+
+	gap := NewQuery("gap", "SELECT * FROM t WHERE a = :a AND b = :b")
+	gap.Mapping = map[string]int{"a": 1, "b": 3}
+	gap.layout = nil
+	if err := gap.checkOrdinals(); err == nil || !strings.Contains(err.Error(), "Query 'gap' binds parameter 'b' to $3") {
+		t.Errorf("expected out of range error, got %v", err)
+	}
+
+	unbound := NewQuery("unbound", "SELECT * FROM t WHERE a = :a AND b = :b")
+	unbound.Mapping = map[string]int{"a": 1}
+	unbound.layout = nil
+	unbound.params = []string{"a", "b"}
+	if err := unbound.checkOrdinals(); err == nil || !strings.Contains(err.Error(), "binds no parameter to placeholder 2") {
+		t.Errorf("expected unbound placeholder error, got %v", err)
+	}
+
+	missing := NewQuery("missing", "SELECT * FROM t WHERE a = :a AND b = :b")
+	missing.OrdinalQuery = "-- missing\nSELECT * FROM t WHERE a = $1 AND b = :b"
+	if err := missing.checkOrdinals(); err == nil || !strings.Contains(err.Error(), "missing placeholder $2") {
+		t.Errorf("expected missing placeholder error, got %v", err)
+	}
+
+	marks := NewQuery("marks", "SELECT * FROM t WHERE a = :a AND b = :b", WithDialect(MySQL))
+	marks.OrdinalQuery = "-- marks\nSELECT * FROM t WHERE a = ? AND b = :b"
+	if err := marks.checkOrdinals(); err == nil || !strings.Contains(err.Error(), "1 placeholders for 2 parameters") {
+		t.Errorf("expected placeholder count error, got %v", err)
+	}
+}
+
+func TestStrayOrdinals(t *testing.T) {
+	testCases := []struct {
+		name        string
+		input       string
+		expectedErr bool
+	}{
+		{name: "named", input: "SELECT * FROM users WHERE id = :id"},
+		{name: "positional", input: "SELECT * FROM users WHERE id = $1 AND name = $2"},
+		{name: "mixed", input: "SELECT * FROM users WHERE id = :id AND name = $5", expectedErr: true},
+		{name: "literal", input: "SELECT 'fee $5', $$ $5 $$ FROM t WHERE id = :id -- not $5"},
+		{name: "after-literal", input: "SELECT 'fee' FROM t WHERE id = :id AND name = $5", expectedErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := NewQueryStore()
+			err := store.loadQueriesFromFile(tc.name+".sql", strings.NewReader(tc.input))
+			if tc.expectedErr {
+				if err == nil || !strings.Contains(err.Error(), "$5") {
+					t.Errorf("expected error naming $5, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("unexpected error %v", err)
+			}
+		})
+	}
+}
+
+func TestSkippedFiles(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"users.sql":      "-- name: get-user\nSELECT * FROM users WHERE id = :id",
+		"orders.sql.bak": "-- name: get-order\nSELECT * FROM orders WHERE id = :id",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store := NewQueryStore()
+	if err := store.LoadFromDir(dir); err != nil {
+		t.Fatalf("LoadFromDir: unexpected error %v", err)
+	}
+	if skipped := store.SkippedFiles(); !reflect.DeepEqual(skipped, []string{filepath.Join(dir, "orders.sql.bak")}) {
+		t.Errorf("SkippedFiles() = %v", skipped)
+	}
+
+	strict := NewQueryStore(WithStrictExtensions())
+	if err := strict.LoadFromDir(dir); err == nil || !strings.Contains(err.Error(), "orders.sql.bak") {
+		t.Errorf("strict LoadFromDir: expected error naming orders.sql.bak, got %v", err)
+	}
+
+	embedded := NewQueryStore()
+	if err := embedded.LoadFromEmbed(embedFS, "testdata/embed"); err != nil {
+		t.Fatalf("LoadFromEmbed: unexpected error %v", err)
+	}
+	if skipped := embedded.SkippedFiles(); !reflect.DeepEqual(skipped, []string{"testdata/embed/users/README.md"}) {
+		t.Errorf("SkippedFiles() = %v", skipped)
+	}
+}
+
+func TestExtensionsAndSkipFunc(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"users.sql":           "-- name: get-user\nSELECT * FROM users WHERE id = :id",
+		"orders.PSQL":         "-- name: get-order\nSELECT * FROM orders WHERE id = :id",
+		"list-items.sql.tmpl": "SELECT * FROM items",
+		"_draft.sql":          "-- name: draft\nSELECT 1",
+		"notes.txt":           "not a query",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store := NewQueryStore(
+		WithExtensions(".sql", ".psql", ".sql.tmpl"),
+		WithSkipFunc(func(path string) bool {
+			return strings.HasPrefix(filepath.Base(path), "_")
+		}),
+	)
+	if err := store.LoadFromDir(dir); err != nil {
+		t.Fatalf("LoadFromDir: unexpected error %v", err)
+	}
+
+	if names := store.Names(); !reflect.DeepEqual(names, []string{"get-order", "get-user", "list-items"}) {
+		t.Errorf("Names() = %v", names)
+	}
+	if skipped := store.SkippedFiles(); !reflect.DeepEqual(skipped, []string{filepath.Join(dir, "notes.txt")}) {
+		t.Errorf("SkippedFiles() = %v", skipped)
+	}
+
+	defaults := NewQueryStore()
+	if err := defaults.LoadFromDir(dir); err != nil {
+		t.Fatalf("LoadFromDir: unexpected error %v", err)
+	}
+	if names := defaults.Names(); !reflect.DeepEqual(names, []string{"draft", "get-user"}) {
+		t.Errorf("default Names() = %v", names)
+	}
+}
+
+func TestNameFromFilename(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"reports/get_active_users.sql": "SELECT * FROM users WHERE active AND tenant_id = :tenant_id",
+		"reports/named.sql":            "\n-- name: get-report\nSELECT * FROM reports WHERE id = :id",
+		"admin/get_active_users.sql":   "SELECT * FROM admins WHERE active",
+	} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store := NewQueryStore()
+	if err := store.LoadFromFile(filepath.Join(dir, "reports", "get_active_users.sql")); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := store.LoadFromFile(filepath.Join(dir, "reports", "named.sql")); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if names := store.Names(); !reflect.DeepEqual(names, []string{"get-report", "get_active_users"}) {
+		t.Errorf("Names() = %v", names)
+	}
+
+	// the same base name in two directories collides unless path names are used
+	err := NewQueryStore().LoadFromDir(dir)
+	if !errors.Is(err, ErrDuplicateQuery) || !strings.Contains(err.Error(), "get_active_users") {
+		t.Errorf("expected duplicate error, got %v", err)
+	}
+
+	pathNames := NewQueryStore(WithPathNames("."))
+	if err := pathNames.LoadFromDir(dir); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if names := pathNames.Names(); !reflect.DeepEqual(names, []string{"admin.get_active_users", "get-report", "reports.get_active_users"}) {
+		t.Errorf("Names() with path names = %v", names)
+	}
+}
+
+func TestDirNamespacing(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"users.sql":               "-- name: get-user\nSELECT * FROM users WHERE id = :id",
+		"reports/sales.sql":       "-- name: get-sales\nSELECT * FROM sales\n\n-- name: get-refunds\nSELECT * FROM refunds",
+		"reports/monthly/top.sql": "SELECT * FROM monthly_top",
+	} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store := NewQueryStore(WithDirNamespacing())
+	if err := store.LoadFromDir(dir); err != nil {
+		t.Fatalf("LoadFromDir: unexpected error %v", err)
+	}
+
+	expected := []string{"get-user", "reports.get-refunds", "reports.get-sales", "reports.monthly.top"}
+	if names := store.Names(); !reflect.DeepEqual(names, expected) {
+		t.Errorf("Names() = %v, expected %v", names, expected)
+	}
+}
+
+func TestResolver(t *testing.T) {
+	traceResolver := func(name string) (interface{}, bool) {
+		if name == "trace_id" {
+			return "trace-123", true
+		}
+		return nil, false
+	}
+
+	q := NewQuery("insert-log", "INSERT INTO logs (trace_id, message, level) VALUES (:trace_id, :message, :level)", WithResolver(traceResolver))
+
+	args := q.Prepare(map[string]interface{}{"message": "hello"})
+	if expected := []interface{}{"trace-123", "hello", nil}; !reflect.DeepEqual(args, expected) {
+		t.Errorf("Prepare: got %v, expected %v", args, expected)
+	}
+
+	args = q.Prepare(map[string]interface{}{"message": "hello", "trace_id": "explicit"})
+	if expected := []interface{}{"explicit", "hello", nil}; !reflect.DeepEqual(args, expected) {
+		t.Errorf("Prepare: got %v, expected %v", args, expected)
+	}
+}
+
+func TestMaxQueries(t *testing.T) {
+	input := `-- name: a
+SELECT 1
+
+-- name: b
+SELECT 2
+
+-- name: c
+SELECT 3`
+
+	store := NewQueryStore(WithMaxQueries(3))
+	if err := store.loadQueriesFromFile("ok.sql", strings.NewReader(input)); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	err := store.loadQueriesFromFile("extra.sql", strings.NewReader("-- name: d\nSELECT 4"))
+	if err == nil || !strings.Contains(err.Error(), "limit of 3") {
+		t.Errorf("expected limit error, got %v", err)
+	}
+	if store.Has("d") {
+		t.Error("query over the limit was registered")
+	}
+}
+
+func TestMaxQueryLength(t *testing.T) {
+	store := NewQueryStore(WithMaxQueryLength(40))
+
+	input := "-- name: short\nSELECT * FROM users WHERE id IN (:ids)\n\n-- name: long\nSELECT id, name, email, created_at FROM users WHERE id = :id"
+	err := store.loadQueriesFromFile("q.sql", strings.NewReader(input))
+	if err == nil || !strings.Contains(err.Error(), "limit of 40") {
+		t.Fatalf("expected length error, got %v", err)
+	}
+	if store.Has("long") {
+		t.Error("query over the length limit was registered")
+	}
+
+	q := NewQuery("short", "SELECT * FROM users WHERE id IN (:ids)", WithMaxQueryLength(40))
+	if _, _, err := q.PrepareExpanded(map[string]interface{}{"ids": []int{1, 2}}); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	ids := make([]int, 100)
+	if _, _, err := q.PrepareExpanded(map[string]interface{}{"ids": ids}); err == nil || !strings.Contains(err.Error(), "limit of 40") {
+		t.Errorf("expected the expanded query to exceed the limit, got %v", err)
+	}
+}
+
+func TestCompileObserver(t *testing.T) {
+	input := "-- name: get\nSELECT * FROM users WHERE id = :id\n\n-- name: find\nSELECT * FROM users WHERE name = :name AND age > :age"
+
+	observed := make(map[string][]string)
+	store := NewQueryStore(WithCompileObserver(func(name, ordinalSQL string, params []string) error {
+		observed[name] = append([]string{ordinalSQL}, params...)
+		return nil
+	}))
+	if err := store.loadQueriesFromFile("users.sql", strings.NewReader(input)); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	expected := map[string][]string{
+		"get":  {"-- get\nSELECT * FROM users WHERE id = $1", "id"},
+		"find": {"-- find\nSELECT * FROM users WHERE name = $1 AND age > $2", "name", "age"},
+	}
+	if !reflect.DeepEqual(observed, expected) {
+		t.Errorf("expected %v, got %v", expected, observed)
+	}
+
+	errRejected := errors.New("rejected by linter")
+	store = NewQueryStore(WithCompileObserver(func(name, ordinalSQL string, params []string) error {
+		if name == "find" {
+			return errRejected
+		}
+		return nil
+	}))
+	err := store.loadQueriesFromFile("users.sql", strings.NewReader(input))
+	if !errors.Is(err, errRejected) || !strings.Contains(err.Error(), "Query 'find'") {
+		t.Errorf("expected the observer error, got %v", err)
+	}
+	if store.Has("find") {
+		t.Error("rejected query was registered")
+	}
+
+	// only registered queries are observed, and the observer may call back
+	// into the store
+	var registered []string
+	store = NewQueryStore(WithMaxQueries(1), WithCompileObserver(func(name, ordinalSQL string, params []string) error {
+		if store.Has(name) {
+			registered = append(registered, name)
+		}
+		return nil
+	}))
+	err = store.loadQueriesFromFile("users.sql", strings.NewReader(input))
+	if err == nil || !strings.Contains(err.Error(), "limit of 1 queries") {
+		t.Errorf("expected limit error, got %v", err)
+	}
+	if expected := []string{"get"}; !reflect.DeepEqual(registered, expected) {
+		t.Errorf("expected %v to be observed, got %v", expected, registered)
+	}
+}
+
+func TestRecompile(t *testing.T) {
+	q := NewQuery("list-users", "SELECT * FROM users WHERE tenant_id = :tenant_id")
+
+	q.Raw += " AND active = :active"
+	if err := q.Recompile(); err != nil {
+		t.Fatalf("Recompile: unexpected error %v", err)
+	}
+
+	if expected := map[string]int{"tenant_id": 1, "active": 2}; !reflect.DeepEqual(q.Mapping, expected) {
+		t.Errorf("Mapping: got %v, expected %v", q.Mapping, expected)
+	}
+	if expected := "-- list-users\nSELECT * FROM users WHERE tenant_id = $1 AND active = $2"; q.OrdinalQuery != expected {
+		t.Errorf("OrdinalQuery: got %s, expected %s", q.OrdinalQuery, expected)
+	}
+	if args := q.Prepare(map[string]interface{}{"tenant_id": 1, "active": true}); !reflect.DeepEqual(args, []interface{}{1, true}) {
+		t.Errorf("Prepare: got %v", args)
+	}
+
+	q.Raw += " OR parent_id = :tenant_id"
+	if err := q.Recompile(WithExpandRepeats()); err != nil {
+		t.Fatalf("Recompile: unexpected error %v", err)
+	}
+	if expected := "-- list-users\nSELECT * FROM users WHERE tenant_id = $1 AND active = $2 OR parent_id = $3"; q.OrdinalQuery != expected {
+		t.Errorf("OrdinalQuery: got %s, expected %s", q.OrdinalQuery, expected)
+	}
+
+	q.Raw += " LIMIT $9"
+	if err := q.Recompile(); err == nil {
+		t.Error("Recompile: expected error for stray placeholder")
+	}
+}
+
+func TestParamPattern(t *testing.T) {
+	query := "SELECT * FROM users WHERE id = :_id AND name = :name"
+
+	q := NewQuery("default", query)
+	if expected := map[string]int{"name": 1}; !reflect.DeepEqual(q.Mapping, expected) {
+		t.Errorf("default Mapping: got %v, expected %v", q.Mapping, expected)
+	}
+
+	q = NewQuery("relaxed", query, WithParamPattern(`[A-Za-z_][A-Za-z0-9_]*`))
+	if expected := map[string]int{"_id": 1, "name": 2}; !reflect.DeepEqual(q.Mapping, expected) {
+		t.Errorf("relaxed Mapping: got %v, expected %v", q.Mapping, expected)
+	}
+	if expected := "-- relaxed\nSELECT * FROM users WHERE id = $1 AND name = $2"; q.OrdinalQuery != expected {
+		t.Errorf("relaxed OrdinalQuery: got %s, expected %s", q.OrdinalQuery, expected)
+	}
+}
+
+func TestParamPatternValidation(t *testing.T) {
+	testCases := []struct {
+		pattern string
+		valid   bool
+	}{
+		{pattern: `[A-Za-z_][A-Za-z0-9_]*`, valid: true},
+		{pattern: `id|[a-z]+`, valid: true},
+		{pattern: `(?i)[a-z]+`, valid: false},
+		{pattern: `\w+`, valid: true},
+		{pattern: `.+`, valid: false},
+		{pattern: `[^:]+`, valid: false},
+		{pattern: `[a-z'"]+`, valid: false},
+		{pattern: `\S+`, valid: false},
+		{pattern: `^[a-z]+`, valid: false},
+		{pattern: `[a-z`, valid: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.pattern, func(t *testing.T) {
+			if err := validateParamPattern(tc.pattern); (err == nil) != tc.valid {
+				t.Errorf("validateParamPattern(%s) = %v; expected valid %v", tc.pattern, err, tc.valid)
+			}
+		})
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("WithParamPattern: expected panic for unsafe pattern")
+		}
+	}()
+	WithParamPattern(`.+`)
+}
+
+func TestQueriesBySource(t *testing.T) {
+	store := NewQueryStore()
+	files := map[string]string{
+		"users.sql":  "-- name: list-users\nSELECT * FROM users\n-- name: get-user\nSELECT * FROM users WHERE id = :id",
+		"orders.sql": "-- name: get-order\nSELECT * FROM orders WHERE id = :id",
+	}
+	for name, content := range files {
+		if err := store.loadQueriesFromFile(name, strings.NewReader(content)); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+
+	expected := map[string][]string{
+		"users.sql":  {"get-user", "list-users"},
+		"orders.sql": {"get-order"},
+	}
+	if sources := store.QueriesBySource(); !reflect.DeepEqual(sources, expected) {
+		t.Errorf("QueriesBySource() = %v; expected %v", sources, expected)
+	}
+	if source := store.MustHaveQuery("get-order").Source; source != "orders.sql" {
+		t.Errorf("Source: got %s, expected orders.sql", source)
+	}
+}
+
+func TestLowercaseParams(t *testing.T) {
+	q := NewQuery("get-user", "SELECT * FROM users WHERE id = :UserID OR parent_id = :userId AND name = :Name", WithLowercaseParams())
+
+	if expected := map[string]int{"userid": 1, "name": 2}; !reflect.DeepEqual(q.Mapping, expected) {
+		t.Errorf("Mapping: got %v, expected %v", q.Mapping, expected)
+	}
+	if expected := "-- get-user\nSELECT * FROM users WHERE id = $1 OR parent_id = $1 AND name = $2"; q.OrdinalQuery != expected {
+		t.Errorf("OrdinalQuery: got %s, expected %s", q.OrdinalQuery, expected)
+	}
+
+	args := q.Prepare(map[string]interface{}{"userid": 1, "NAME": "john"})
+	if expected := []interface{}{1, "john"}; !reflect.DeepEqual(args, expected) {
+		t.Errorf("Prepare: got %v, expected %v", args, expected)
+	}
+}
+
+func TestCaseInsensitiveArgs(t *testing.T) {
+	q := NewQuery("get-user", "SELECT * FROM users WHERE id = :userID AND team = :teamId", WithCaseInsensitiveArgs())
+
+	if expected := map[string]int{"userID": 1, "teamId": 2}; !reflect.DeepEqual(q.Mapping, expected) {
+		t.Errorf("Mapping: got %v, expected %v", q.Mapping, expected)
+	}
+	if expected := "-- get-user\nSELECT * FROM users WHERE id = $1 AND team = $2"; q.OrdinalQuery != expected {
+		t.Errorf("OrdinalQuery: got %s, expected %s", q.OrdinalQuery, expected)
+	}
+
+	args := map[string]interface{}{"userid": 1, "TEAMID": 2}
+	if prepared := q.Prepare(args); !reflect.DeepEqual(prepared, []interface{}{1, 2}) {
+		t.Errorf("unexpected arguments %v", prepared)
+	}
+	if prepared := NewQuery("get-user", q.Raw).Prepare(args); !reflect.DeepEqual(prepared, []interface{}{nil, nil}) {
+		t.Errorf("arguments matched case-insensitively by default: %v", prepared)
+	}
+
+	// the exact spelling wins over a case-insensitive match
+	exact := map[string]interface{}{"userid": 1, "userID": 10, "teamId": 2}
+	if prepared := q.Prepare(exact); !reflect.DeepEqual(prepared, []interface{}{10, 2}) {
+		t.Errorf("unexpected arguments %v", prepared)
+	}
+
+	if _, err := q.PrepareStrict(args); err != nil {
+		t.Errorf("PrepareStrict: unexpected error %v", err)
+	}
+	if _, err := q.PrepareStrict(exact); err == nil || !strings.Contains(err.Error(), "unknown arguments userid") {
+		t.Errorf("PrepareStrict: expected the shadowed argument to be unknown, got %v", err)
+	}
+
+	// spellings colliding on the same parameter are not picked at random
+	colliding := map[string]interface{}{"userid": 1, "USERID": 2, "teamId": 3}
+	if prepared := q.Prepare(colliding); !reflect.DeepEqual(prepared, []interface{}{nil, 3}) {
+		t.Errorf("unexpected arguments %v", prepared)
+	}
+	if _, err := q.PrepareStrict(colliding); err == nil || !strings.Contains(err.Error(), "missing arguments userID; unknown arguments USERID, userid") {
+		t.Errorf("PrepareStrict: expected the colliding arguments to be reported, got %v", err)
+	}
+
+	store := NewQueryStore(WithCaseInsensitiveArgs())
+	err := store.loadQueriesFromFile("users.sql", strings.NewReader("-- name: ambiguous\nSELECT * FROM users WHERE id = :userID OR id = :userid"))
+	if err == nil || !strings.Contains(err.Error(), "'userID' and 'userid' differing only in case") {
+		t.Errorf("expected ambiguity error, got %v", err)
+	}
+}
+
+func TestLoadFromTemplate(t *testing.T) {
+	tmpl := `{{range .}}-- name: count-events-{{.}}
+SELECT count(*) FROM events_{{.}} WHERE created_at > :since
+{{end}}`
+
+	store := NewQueryStore()
+	if err := store.LoadFromTemplate("events", tmpl, []string{"2023", "2024"}); err != nil {
+		t.Fatalf("LoadFromTemplate: unexpected error %v", err)
+	}
+
+	if names := store.Names(); !reflect.DeepEqual(names, []string{"count-events-2023", "count-events-2024"}) {
+		t.Fatalf("Names() = %v", names)
+	}
+
+	q := store.MustHaveQuery("count-events-2024")
+	if expected := "-- count-events-2024\nSELECT count(*) FROM events_2024 WHERE created_at > $1"; q.OrdinalQuery != expected {
+		t.Errorf("OrdinalQuery: got %s, expected %s", q.OrdinalQuery, expected)
+	}
+
+	if err := store.LoadFromTemplate("single", "SELECT {{.}} FROM t WHERE id = :id", "name"); err != nil {
+		t.Fatalf("LoadFromTemplate: unexpected error %v", err)
+	}
+	if q := store.MustHaveQuery("single"); q.Raw != "SELECT name FROM t WHERE id = :id" {
+		t.Errorf("Raw: got %s", q.Raw)
+	}
+
+	if err := store.LoadFromTemplate("broken", "{{.Missing", nil); err == nil {
+		t.Error("expected error for invalid template")
+	}
+}
+
+func TestPlaceholderCount(t *testing.T) {
+	testCases := []struct {
+		name  string
+		query string
+		count int
+	}{
+		{name: "none", query: "SELECT 1", count: 0},
+		{name: "repeated", query: "SELECT * FROM t WHERE a = :a OR b = :a AND c = :c", count: 2},
+		{name: "ten", query: "SELECT :a1, :a2, :a3, :a4, :a5, :a6, :a7, :a8, :a9, :a10", count: 10},
+		{name: "literal", query: "SELECT * FROM t WHERE note = 'costs $2' AND id = :id /* $3 */", count: 1},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			q := NewQuery(tc.name, tc.query, WithDebugChecks())
+			q.Prepare(map[string]interface{}{})
+			if count := q.PlaceholderCount(); count != tc.count || count != len(q.Mapping) {
+				t.Errorf("PlaceholderCount() = %d; expected %d (mapping %d)", count, tc.count, len(q.Mapping))
+			}
+		})
+	}
+}
+
+// Names sharing a prefix used to be replaced in map order, so :user could
+// rewrite the beginning of :user_id
+func TestPrefixCollision(t *testing.T) {
+	query := "SELECT * FROM t WHERE user_id = :user_id AND owner = :user AND tag = :user_id_tag"
+	expected := "-- prefix\nSELECT * FROM t WHERE user_id = $1 AND owner = $2 AND tag = $3"
+
+	for i := 0; i < 50; i++ {
+		q := NewQuery("prefix", query)
+		if q.OrdinalQuery != expected {
+			t.Fatalf("OrdinalQuery: got %s, expected %s", q.OrdinalQuery, expected)
+		}
+		if q.PlaceholderCount() != len(q.Mapping) {
+			t.Fatalf("PlaceholderCount() = %d; expected %d", q.PlaceholderCount(), len(q.Mapping))
+		}
+	}
+}
+
+func TestDuplicatePolicy(t *testing.T) {
+	original := "-- name: get-user\nSELECT * FROM users WHERE id = :id"
+	changed := "-- name: get-user\nSELECT * FROM users WHERE id = :id AND deleted_at IS NULL"
+
+	testCases := []struct {
+		name        string
+		policy      DuplicatePolicy
+		second      string
+		expectedErr bool
+		expectedRaw string
+		samePointer bool
+		used        bool
+	}{
+		{name: "error", policy: DuplicateError, second: original, expectedErr: true, expectedRaw: "SELECT * FROM users WHERE id = :id", samePointer: true, used: true},
+		{name: "override-identical", policy: DuplicateOverride, second: original, expectedRaw: "SELECT * FROM users WHERE id = :id", samePointer: true, used: true},
+		{name: "override-changed", policy: DuplicateOverride, second: changed, expectedRaw: "SELECT * FROM users WHERE id = :id AND deleted_at IS NULL", used: true},
+		{name: "ignore-identical", policy: DuplicateIgnore, second: original, expectedRaw: "SELECT * FROM users WHERE id = :id", samePointer: true, used: true},
+		{name: "ignore-changed", policy: DuplicateIgnore, second: changed, expectedRaw: "SELECT * FROM users WHERE id = :id AND deleted_at IS NULL"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := NewQueryStore(WithDuplicatePolicy(tc.policy))
+			if err := store.loadQueriesFromFile("a.sql", strings.NewReader(original)); err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			first := store.MustHaveQuery("get-user")
+
+			err := store.loadQueriesFromFile("b.sql", strings.NewReader(tc.second))
+			if (err != nil) != tc.expectedErr {
+				t.Fatalf("second load: got error %v, expected error %v", err, tc.expectedErr)
+			}
+
+			used := len(store.UnusedQueries()) == 0
+			q := store.MustHaveQuery("get-user")
+			if q.Raw != tc.expectedRaw {
+				t.Errorf("Raw: got %s, expected %s", q.Raw, tc.expectedRaw)
+			}
+			if (q == first) != tc.samePointer {
+				t.Errorf("same query: got %v, expected %v", q == first, tc.samePointer)
+			}
+			if used != tc.used {
+				t.Errorf("used: got %v, expected %v", used, tc.used)
+			}
+		})
+	}
+}
+
+func TestLoadFromFSFile(t *testing.T) {
+	fsys := fstest.MapFS{
+		"sql/users.sql": {Data: []byte("-- name: get-user\nSELECT * FROM users WHERE id = :id")},
+		"sql/count.sql": {Data: []byte("SELECT count(*) FROM users")},
+	}
+
+	store := NewQueryStore()
+	for _, name := range []string{"sql/users.sql", "sql/count.sql"} {
+		file, err := fsys.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := store.LoadFromFSFile(name, file); err != nil {
+			t.Fatalf("LoadFromFSFile(%s): unexpected error %v", name, err)
+		}
+		file.Close()
+	}
+
+	if names := store.Names(); !reflect.DeepEqual(names, []string{"count", "get-user"}) {
+		t.Errorf("Names() = %v", names)
+	}
+	if source := store.MustHaveQuery("get-user").Source; source != "sql/users.sql" {
+		t.Errorf("Source: got %s", source)
+	}
+}
+
+func TestCombine(t *testing.T) {
+	users := NewQuery("users", "SELECT id, name FROM users WHERE tenant_id = :tenant_id AND name LIKE :name")
+	groups := NewQuery("groups", "SELECT id, title FROM groups WHERE tenant_id = :tenant_id AND kind = :kind")
+
+	combined, err := Combine("\nUNION ALL\n", users, groups)
+	if err != nil {
+		t.Fatalf("Combine: unexpected error %v", err)
+	}
+
+	if combined.Name != "users+groups" {
+		t.Errorf("Name: got %s", combined.Name)
+	}
+	expectedOrd := "-- users+groups\nSELECT id, name FROM users WHERE tenant_id = $1 AND name LIKE $2\nUNION ALL\nSELECT id, title FROM groups WHERE tenant_id = $1 AND kind = $3"
+	if combined.OrdinalQuery != expectedOrd {
+		t.Errorf("OrdinalQuery: got %s, expected %s", combined.OrdinalQuery, expectedOrd)
+	}
+	if expected := map[string]int{"tenant_id": 1, "name": 2, "kind": 3}; !reflect.DeepEqual(combined.Mapping, expected) {
+		t.Errorf("Mapping: got %v, expected %v", combined.Mapping, expected)
+	}
+
+	args := combined.Prepare(map[string]interface{}{"tenant_id": 1, "name": "a%", "kind": "admin"})
+	if expected := []interface{}{1, "a%", "admin"}; !reflect.DeepEqual(args, expected) {
+		t.Errorf("Prepare: got %v, expected %v", args, expected)
+	}
+
+	store := NewQueryStore()
+	if err := store.loadQueriesFromFile("users.sql", strings.NewReader("-- name: users\n-- style: question\nSELECT id FROM users WHERE org = :org\n\n-- name: groups\n-- style: question\nSELECT id FROM groups WHERE org = :org")); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	combined, err = Combine(" UNION ", store.MustHaveQuery("users"), store.MustHaveQuery("groups"))
+	if err != nil {
+		t.Fatalf("Combine: unexpected error %v", err)
+	}
+	if expected := "-- users+groups\nSELECT id FROM users WHERE org = ? UNION SELECT id FROM groups WHERE org = ?"; combined.OrdinalQuery != expected {
+		t.Errorf("OrdinalQuery: got %q, expected %q", combined.OrdinalQuery, expected)
+	}
+
+	withDefault := NewQuery("admins", "SELECT id FROM admins WHERE org = :org AND role = :role")
+	withDefault.Defaults = map[string]interface{}{"role": "owner"}
+	combined, err = Combine(" UNION ", users, withDefault)
+	if err != nil {
+		t.Fatalf("Combine: unexpected error %v", err)
+	}
+	if prepared := combined.Prepare(map[string]interface{}{"tenant_id": 1, "name": "a%", "org": 2}); !reflect.DeepEqual(prepared, []interface{}{1, "a%", 2, "owner"}) {
+		t.Errorf("Prepare: got %v", prepared)
+	}
+
+	if _, err := Combine(" UNION "); err == nil {
+		t.Error("Combine: expected error without queries")
+	}
+}
+
+func TestDebugChecks(t *testing.T) {
+	args := map[string]interface{}{"id": 1, "name": "john"}
+
+	q := NewQuery("get-user", "SELECT * FROM users WHERE id = :id AND name = :name", WithDebugChecks())
+	if prepared := q.Prepare(args); len(prepared) != 2 {
+		t.Fatalf("Prepare: got %v", prepared)
+	}
+
+	q.OrdinalQuery = "-- get-user\nSELECT * FROM users WHERE id = $1"
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Prepare: expected panic for inconsistent query")
+		}
+	}()
+	q.Prepare(args)
+}
+
+func TestLoadFromEmbeds(t *testing.T) {
+	store := NewQueryStore()
+	err := store.LoadFromEmbeds(
+		EmbedEntry{FS: embedFS, Path: "testdata/embed"},
+		EmbedEntry{FS: billingFS, Path: "testdata/billing"},
+	)
+	if err != nil {
+		t.Fatalf("LoadFromEmbeds: unexpected error %v", err)
+	}
+
+	expected := []string{"count", "get", "get-invoice", "list-admins", "list-invoices", "top"}
+	if names := store.Names(); !reflect.DeepEqual(names, expected) {
+		t.Errorf("Names() = %v; expected %v", names, expected)
+	}
+
+	err = store.LoadFromEmbeds(EmbedEntry{FS: billingFS, Path: "testdata/billing"})
+	if err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Errorf("LoadFromEmbeds: expected duplicate error, got %v", err)
+	}
+}
+
+func TestParamUsageReport(t *testing.T) {
+	input := `-- name: list-users
+SELECT * FROM users WHERE tenant_id = :tenant_id
+
+-- name: list-groups
+SELECT * FROM groups WHERE tenant_id = :tenant_id OR owner_tenant_id = :tenant_id AND kind = :kind`
+
+	store := NewQueryStore()
+	if err := store.loadQueriesFromFile("tenants.sql", strings.NewReader(input)); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	var report []struct {
+		Param   string `json:"param"`
+		Total   int    `json:"total"`
+		Queries []struct {
+			Query       string `json:"query"`
+			Occurrences int    `json:"occurrences"`
+		} `json:"queries"`
+	}
+	if err := json.Unmarshal(store.ParamUsageReport(), &report); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+
+	if len(report) != 2 || report[0].Param != "kind" || report[1].Param != "tenant_id" {
+		t.Fatalf("unexpected report %+v", report)
+	}
+
+	tenant := report[1]
+	if tenant.Total != 3 || len(tenant.Queries) != 2 {
+		t.Fatalf("unexpected tenant_id usage %+v", tenant)
+	}
+	if tenant.Queries[0].Query != "list-groups" || tenant.Queries[0].Occurrences != 2 {
+		t.Errorf("unexpected list-groups usage %+v", tenant.Queries[0])
+	}
+	if tenant.Queries[1].Query != "list-users" || tenant.Queries[1].Occurrences != 1 {
+		t.Errorf("unexpected list-users usage %+v", tenant.Queries[1])
+	}
+}
+
+func TestRequire(t *testing.T) {
+	input := `-- name: get-user
+SELECT * FROM users WHERE id = :id
+
+-- name: list-users
+SELECT * FROM users`
+
+	store := NewQueryStore()
+	if err := store.loadQueriesFromFile("users.sql", strings.NewReader(input)); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if err := store.Require("get-user", "list-users"); err != nil {
+		t.Errorf("expected all queries to be present, got %v", err)
+	}
+
+	err := store.Require("get-user", "delete-user", "update-user")
+	if err == nil {
+		t.Fatal("expected error for missing queries")
+	}
+	if err.Error() != "Required queries not found: delete-user, update-user" {
+		t.Errorf("unexpected error %v", err)
+	}
+	if !errors.Is(err, ErrQueryNotFound) {
+		t.Errorf("expected ErrQueryNotFound, got %v", err)
+	}
+}
+
+type slowFile struct {
+	delay time.Duration
+	data  *strings.Reader
+}
+
+func (f *slowFile) Stat() (fs.FileInfo, error) { return nil, fs.ErrInvalid }
+func (f *slowFile) Close() error               { return nil }
+
+func (f *slowFile) Read(p []byte) (int, error) {
+	time.Sleep(f.delay)
+	return f.data.Read(p)
+}
+
+func TestReadTimeout(t *testing.T) {
+	input := "-- name: get-user\nSELECT * FROM users WHERE id = :id"
+
+	store := NewQueryStore(WithReadTimeout(10 * time.Millisecond))
+	err := store.LoadFromFSFile("slow.sql", &slowFile{delay: time.Second, data: strings.NewReader(input)})
+	if err == nil {
+		t.Fatal("expected timeout error")
+	}
+	if !strings.Contains(err.Error(), "slow.sql") || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("unexpected error %v", err)
+	}
+	if store.Has("get-user") {
+		t.Error("expected no query to be loaded")
+	}
+
+	store = NewQueryStore(WithReadTimeout(time.Second))
+	err = store.LoadFromFSFile("fast.sql", &slowFile{data: strings.NewReader(input)})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !store.Has("get-user") {
+		t.Error("expected query to be loaded")
+	}
+}
+
+func TestPrepareDerefPointers(t *testing.T) {
+	var (
+		nilInt    *int
+		nilString *string
+		age       = 42
+		name      = "alice"
+	)
+
+	sql := "UPDATE users SET age = :age, name = :name WHERE id = :id"
+
+	q := NewQuery("update-user", sql, WithDerefPointers())
+	args := q.Prepare(map[string]interface{}{"age": nilInt, "name": nilString, "id": 1})
+	if !reflect.DeepEqual(args, []interface{}{nil, nil, 1}) {
+		t.Errorf("expected typed nil pointers to become nil, got %#v", args)
+	}
+	if args[0] != nil || args[1] != nil {
+		t.Errorf("expected untyped nil, got %#v", args)
+	}
+
+	args = q.Prepare(map[string]interface{}{"age": &age, "name": &name, "id": 1})
+	if !reflect.DeepEqual(args, []interface{}{42, "alice", 1}) {
+		t.Errorf("expected pointers to be dereferenced, got %#v", args)
+	}
+
+	q = NewQuery("update-user", sql)
+	args = q.Prepare(map[string]interface{}{"age": nilInt, "name": &name, "id": 1})
+	if args[0] == nil || args[1] != &name {
+		t.Errorf("expected pointers to be kept without the option, got %#v", args)
+	}
+}
+
+func TestUniqueAndReusedParams(t *testing.T) {
+	q := NewQuery("search", "SELECT * FROM users WHERE (name = :term OR email = :term) AND tenant_id = :tenant_id AND status = :status")
+
+	if unique := q.UniqueParams(); !reflect.DeepEqual(unique, []string{"status", "tenant_id"}) {
+		t.Errorf("unexpected unique params %v", unique)
+	}
+	if reused := q.ReusedParams(); !reflect.DeepEqual(reused, []string{"term"}) {
+		t.Errorf("unexpected reused params %v", reused)
+	}
+
+	q = NewQuery("list", "SELECT * FROM users")
+	if unique, reused := q.UniqueParams(), q.ReusedParams(); len(unique) != 0 || len(reused) != 0 {
+		t.Errorf("expected no params, got %v and %v", unique, reused)
+	}
+}
+
+func TestPlaceholderStyleMetadata(t *testing.T) {
+	input := `-- name: get-user
+SELECT * FROM users WHERE id = :id AND tenant_id = :tenant_id
+
+-- name: find-order
+-- style: question
+SELECT * FROM orders WHERE user_id = :user_id OR owner_id = :user_id AND status = :status
+
+-- name: list-orders
+-- style: dollar
+SELECT * FROM orders WHERE user_id = :user_id`
+
+	store := NewQueryStore(WithDebugChecks())
+	if err := store.loadQueriesFromFile("mixed.sql", strings.NewReader(input)); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	expected := map[string]string{
+		"get-user":    "-- get-user\nSELECT * FROM users WHERE id = $1 AND tenant_id = $2",
+		"find-order":  "-- find-order\nSELECT * FROM orders WHERE user_id = ? OR owner_id = ? AND status = ?",
+		"list-orders": "-- list-orders\nSELECT * FROM orders WHERE user_id = $1",
+	}
+	for name, sql := range expected {
+		if q := store.MustHaveQuery(name); q.Query() != sql {
+			t.Errorf("%s: expected %q, got %q", name, sql, q.Query())
+		}
+	}
+
+	args := store.MustHaveQuery("find-order").Prepare(map[string]interface{}{"user_id": 1, "status": "open"})
+	if !reflect.DeepEqual(args, []interface{}{1, 1, "open"}) {
+		t.Errorf("unexpected arguments %v", args)
+	}
+
+	store = NewQueryStore()
+	err := store.loadQueriesFromFile("bad.sql", strings.NewReader("-- name: bad\n-- style: colon\nSELECT :id"))
+	if err == nil || !strings.Contains(err.Error(), "unknown placeholder style 'colon'") {
+		t.Errorf("expected unknown style error, got %v", err)
+	}
+}
+
+func TestArrayConstructorParams(t *testing.T) {
+	q := NewQuery("tagged", "SELECT * FROM posts WHERE tags && ARRAY[:a, :b]::text[]")
+
+	if !reflect.DeepEqual(q.Mapping, map[string]int{"a": 1, "b": 2}) {
+		t.Errorf("unexpected mapping %v", q.Mapping)
+	}
+
+	expected := "-- tagged\nSELECT * FROM posts WHERE tags && ARRAY[$1, $2]::text[]"
+	if q.Query() != expected {
+		t.Errorf("expected %q, got %q", expected, q.Query())
+	}
+}
+
+func TestAnnotated(t *testing.T) {
+	q := NewQuery("find-user", "SELECT * FROM users WHERE id = :id OR (tenant_id = :tenant_id AND parent_id = :id)")
+
+	expected := "-- find-user\nSELECT * FROM users WHERE id = $1 /* id */ OR (tenant_id = $2 /* tenant_id */ AND parent_id = $1 /* id */)"
+	if annotated := q.Annotated(); annotated != expected {
+		t.Errorf("expected %q, got %q", expected, annotated)
+	}
+
+	q = NewQuery("find-user", "SELECT * FROM users WHERE id = :id OR parent_id = :id", WithExpandRepeats())
+
+	expected = "-- find-user\nSELECT * FROM users WHERE id = $1 /* id */ OR parent_id = $2 /* id */"
+	if annotated := q.Annotated(); annotated != expected {
+		t.Errorf("expected %q, got %q", expected, annotated)
+	}
+}
+
+func TestLoadFilter(t *testing.T) {
+	input := `-- name: list-users
+SELECT * FROM users
+
+-- name: seed-users
+-- env: dev
+INSERT INTO users (name) VALUES ('test')
+
+-- name: purge-users
+-- env: prod
+DELETE FROM users WHERE deleted_at < :cutoff`
+
+	store := NewQueryStore(WithLoadFilter(func(name string, metadata map[string]string) bool {
+		env, ok := metadata["env"]
+		return !ok || env == "prod"
+	}))
+	if err := store.loadQueriesFromFile("users.sql", strings.NewReader(input)); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if names := store.Names(); !reflect.DeepEqual(names, []string{"list-users", "purge-users"}) {
+		t.Errorf("unexpected queries %v", names)
+	}
+
+	// the filter may call back into the store
+	store = NewQueryStore(WithDuplicatePolicy(DuplicateOverride), WithLoadFilter(func(name string, _ map[string]string) bool {
+		return !store.Has(name)
+	}))
+	if err := store.loadQueriesFromFile("users.sql", strings.NewReader("-- name: get-user\nSELECT 1")); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := store.loadQueriesFromFile("users.sql", strings.NewReader("-- name: get-user\nSELECT 2")); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if raw := store.MustHaveQuery("get-user").Raw; raw != "SELECT 1" {
+		t.Errorf("expected the loaded query to be filtered out, got %q", raw)
+	}
+}
+
+func TestMixedQuestionMarks(t *testing.T) {
+	testCases := []struct {
+		name        string
+		input       string
+		expectedErr bool
+	}{
+		{name: "named", input: "SELECT * FROM users WHERE id = :id AND name = :name"},
+		{name: "question", input: "SELECT * FROM users WHERE id = ? AND name = ?"},
+		{name: "mixed", input: "SELECT * FROM users WHERE id = :id AND name = ?", expectedErr: true},
+		{name: "mixed-in-list", input: "INSERT INTO users (id, name) VALUES (:id, ?)", expectedErr: true},
+		{name: "literal", input: "SELECT * FROM users WHERE id = :id AND note = 'why?' -- really?"},
+		{name: "jsonb", input: "SELECT * FROM users WHERE id = :id AND data ? 'admin' AND data ?| array['a'] AND tags ? :tag"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := NewQueryStore()
+			err := store.loadQueriesFromFile(tc.name+".sql", strings.NewReader(tc.input))
+			if tc.expectedErr {
+				if err == nil || !strings.Contains(err.Error(), "Query '"+tc.name+"'") || !strings.Contains(err.Error(), "?") {
+					t.Errorf("expected error naming the query and ?, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("unexpected error %v", err)
+			}
+		})
+	}
+}
+
+func TestLogFields(t *testing.T) {
+	q := NewQuery("login", "SELECT * FROM users WHERE email = :email AND password_hash = crypt(:password, password_hash)")
+
+	fields := q.LogFields(map[string]interface{}{"email": "alice@example.com", "password": "hunter2", "unused": 42})
+
+	if fields["query"] != "login" || fields["sql"] != q.OrdinalQuery {
+		t.Errorf("unexpected query fields %v", fields)
+	}
+	if params := fields["params"]; !reflect.DeepEqual(params, []string{"email", "password"}) {
+		t.Errorf("unexpected params %v", params)
+	}
+	if args := fields["args"]; !reflect.DeepEqual(args, map[string]string{"email": "[REDACTED]", "password": "[REDACTED]"}) {
+		t.Errorf("unexpected args %v", args)
+	}
+
+	dump := fmt.Sprintf("%v", fields)
+	for _, value := range []string{"alice@example.com", "hunter2", "42"} {
+		if strings.Contains(dump, value) {
+			t.Errorf("bound value %q leaked into %s", value, dump)
+		}
+	}
+}
+
+func TestLoadFromDirTwice(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"users.sql":  "-- name: get-user\nSELECT * FROM users WHERE id = :id",
+		"orders.sql": "-- name: get-order\nSELECT * FROM orders WHERE id = :id",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, policy := range []DuplicatePolicy{DuplicateOverride, DuplicateIgnore} {
+		store := NewQueryStore(WithDuplicatePolicy(policy))
+		if err := store.LoadFromDir(dir); err != nil {
+			t.Fatalf("first LoadFromDir: unexpected error %v", err)
+		}
+
+		first := store.MustHaveQuery("get-user")
+
+		if err := store.LoadFromDir(dir); err != nil {
+			t.Fatalf("second LoadFromDir: unexpected error %v", err)
+		}
+
+		if names := store.Names(); !reflect.DeepEqual(names, []string{"get-order", "get-user"}) {
+			t.Errorf("unexpected queries %v", names)
+		}
+		if store.MustHaveQuery("get-user") != first {
+			t.Errorf("policy %d: expected identical query to be kept", policy)
+		}
+	}
+}
+
+func TestNullBound(t *testing.T) {
+	q := NewQuery("find-user", "SELECT * FROM users WHERE id = :id OR (tenant_id = :tenant_id AND parent_id = :id)")
+
+	expected := "-- find-user\nSELECT * FROM users WHERE id = NULL::unknown OR (tenant_id = NULL::unknown AND parent_id = NULL::unknown)"
+	if bound := q.NullBound(); bound != expected {
+		t.Errorf("expected %q, got %q", expected, bound)
+	}
+	if placeholders := numberedPlaceholders(q.NullBound(), "$"); len(placeholders) > 0 {
+		t.Errorf("expected no placeholders left in %q", q.NullBound())
+	}
+}
+
+func TestCommentMarkers(t *testing.T) {
+	input := `-- name: get-user
+# formerly filtered by :legacy_id
+SELECT * FROM users WHERE id = :id # and not :other`
+
+	store := NewQueryStore(WithCommentMarkers("#"))
+	if err := store.loadQueriesFromFile("users.sql", strings.NewReader(input)); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	q := store.MustHaveQuery("get-user")
+	if !reflect.DeepEqual(q.Mapping, map[string]int{"id": 1}) {
+		t.Errorf("unexpected mapping %v", q.Mapping)
+	}
+	if q.Query() != "-- get-user\nSELECT * FROM users WHERE id = $1" {
+		t.Errorf("unexpected query %q", q.Query())
+	}
+}
+
+func TestQueriesWithPrefix(t *testing.T) {
+	input := `-- name: users.get
+SELECT * FROM users WHERE id = :id
+
+-- name: users.list
+SELECT * FROM users
+
+-- name: orders.list
+SELECT * FROM orders`
+
+	store := NewQueryStore()
+	if err := store.loadQueriesFromFile("all.sql", strings.NewReader(input)); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	users := store.QueriesWithPrefix("users.")
+	if len(users) != 2 || users["users.get"] == nil || users["users.list"] == nil {
+		t.Errorf("unexpected queries %v", users)
+	}
+
+	delete(users, "users.get")
+	if !store.Has("users.get") {
+		t.Error("expected the store to be unaffected by changes to the result")
+	}
+
+	if none := store.QueriesWithPrefix("invoices."); len(none) != 0 {
+		t.Errorf("expected no queries, got %v", none)
+	}
+}
+
+func TestValuesRowsParams(t *testing.T) {
+	q := NewQuery("bulk-insert", "INSERT INTO t (a,b) VALUES (:a1,:b1),(:a2,:b2)")
+
+	expectedMapping := map[string]int{"a1": 1, "b1": 2, "a2": 3, "b2": 4}
+	if !reflect.DeepEqual(q.Mapping, expectedMapping) {
+		t.Errorf("unexpected mapping %v", q.Mapping)
+	}
+
+	expected := "-- bulk-insert\nINSERT INTO t (a,b) VALUES ($1,$2),($3,$4)"
+	if q.Query() != expected {
+		t.Errorf("expected %q, got %q", expected, q.Query())
+	}
+}
+
+func TestParamsInLiteralsAndComments(t *testing.T) {
+	testCases := []struct {
+		name     string
+		input    string
+		expected string
+		mapping  map[string]int
+	}{
+		{
+			name:     "string-literal",
+			input:    "SELECT 'hello :world' FROM t WHERE id = :id",
+			expected: "SELECT 'hello :world' FROM t WHERE id = $1",
+			mapping:  map[string]int{"id": 1},
+		},
+		{
+			name:     "escaped-quote",
+			input:    "SELECT 'it''s :world' FROM t WHERE id = :id",
+			expected: "SELECT 'it''s :world' FROM t WHERE id = $1",
+			mapping:  map[string]int{"id": 1},
+		},
+		{
+			name:     "quoted-identifier",
+			input:    `SELECT "weird:column" FROM t WHERE id = :id`,
+			expected: `SELECT "weird:column" FROM t WHERE id = $1`,
+			mapping:  map[string]int{"id": 1},
+		},
+		{
+			name:     "dollar-quoted",
+			input:    "SELECT $body$ :world $body$, $$ :other $$ FROM t WHERE id = :id",
+			expected: "SELECT $body$ :world $body$, $$ :other $$ FROM t WHERE id = $1",
+			mapping:  map[string]int{"id": 1},
+		},
+		{
+			name:     "line-comment",
+			input:    "SELECT * FROM t -- filter by :foo\nWHERE id = :id",
+			expected: "SELECT * FROM t -- filter by :foo\nWHERE id = $1",
+			mapping:  map[string]int{"id": 1},
+		},
+		{
+			name:     "block-comment",
+			input:    "SELECT * FROM t /* was :foo\nand :bar */ WHERE id = :id",
+			expected: "SELECT * FROM t /* was :foo\nand :bar */ WHERE id = $1",
+			mapping:  map[string]int{"id": 1},
+		},
+		{
+			name:     "cast",
+			input:    "SELECT :value::text, '1'::int FROM t",
+			expected: "SELECT $1::text, '1'::int FROM t",
+			mapping:  map[string]int{"value": 1},
+		},
+		{
+			name:     "psql-quoted-variable",
+			input:    "SELECT * FROM t WHERE name = :'name' AND id = :id",
+			expected: "SELECT * FROM t WHERE name = $1 AND id = $2",
+			mapping:  map[string]int{"name": 1, "id": 2},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			q := NewQuery(tc.name, tc.input)
+
+			if q.Query() != "-- "+tc.name+"\n"+tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, q.Query())
+			}
+			if !reflect.DeepEqual(q.Mapping, tc.mapping) {
+				t.Errorf("expected mapping %v, got %v", tc.mapping, q.Mapping)
+			}
+		})
+	}
+}
+
+func TestTryQuery(t *testing.T) {
+	store := NewQueryStore()
+	if err := store.loadQueriesFromFile("users.sql", strings.NewReader("-- name: get-user\nSELECT * FROM users WHERE id = :id")); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if q, err := store.QuerySafe("get-user"); err != nil || q.Name != "get-user" {
+		t.Errorf("QuerySafe: got %v, %v", q, err)
+	}
+	if _, err := store.QuerySafe("missing"); err == nil {
+		t.Error("QuerySafe: expected error for missing query")
+	}
+
+	var called bool
+	err := store.TryQuery("get-user", func(q *Query) error {
+		called = true
+		return nil
+	})
+	if err != nil || !called {
+		t.Errorf("TryQuery: expected fn to be called without error, got %v", err)
+	}
+
+	err = store.TryQuery("get-user", func(q *Query) error {
+		store.MustHaveQuery("missing")
+		return nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "Query 'get-user' panicked") || !strings.Contains(err.Error(), "Query 'missing' not found") {
+		t.Errorf("TryQuery: expected recovered panic, got %v", err)
+	}
+
+	err = store.TryQuery("missing", func(q *Query) error {
+		t.Error("TryQuery: fn called for missing query")
+		return nil
+	})
+	if err == nil {
+		t.Error("TryQuery: expected error for missing query")
+	}
+}
+
+func TestResultColumns(t *testing.T) {
+	input := `-- name: get-user
+-- returns: id int, name text, balance numeric(10, 2), created_at timestamp with time zone, note
+SELECT id, name, balance, created_at, note FROM users WHERE id = :id
+
+-- name: touch-user
+UPDATE users SET touched_at = now() WHERE id = :id`
+
+	store := NewQueryStore()
+	if err := store.loadQueriesFromFile("users.sql", strings.NewReader(input)); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	expected := []ResultColumn{
+		{Name: "id", Type: "int"},
+		{Name: "name", Type: "text"},
+		{Name: "balance", Type: "numeric(10, 2)"},
+		{Name: "created_at", Type: "timestamp with time zone"},
+		{Name: "note"},
+	}
+	if columns := store.MustHaveQuery("get-user").ResultColumns; !reflect.DeepEqual(columns, expected) {
+		t.Errorf("expected %v, got %v", expected, columns)
+	}
+	if columns := store.MustHaveQuery("touch-user").ResultColumns; columns != nil {
+		t.Errorf("expected no result columns, got %v", columns)
+	}
+
+	err := store.loadQueriesFromFile("bad.sql", strings.NewReader("-- name: bad\n-- returns: id int,, name\nSELECT 1"))
+	if err == nil || !strings.Contains(err.Error(), "invalid returns metadata") {
+		t.Errorf("expected invalid returns error, got %v", err)
+	}
+}
+
+func TestPrepareStrict(t *testing.T) {
+	q := NewQuery("update-user", "UPDATE users SET name = :name, updated_at = :@now WHERE id = :id AND tenant_id = :tenant_id")
+
+	args, err := q.PrepareStrict(map[string]interface{}{"name": "alice", "id": 1, "tenant_id": 2})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(args) != 4 || args[0] != "alice" || args[2] != 1 || args[3] != 2 {
+		t.Errorf("unexpected arguments %v", args)
+	}
+
+	_, err = q.PrepareStrict(map[string]interface{}{"name": "alice", "user_id": 1})
+	if err == nil {
+		t.Fatal("expected error for missing and unknown arguments")
+	}
+	expected := "Query 'update-user': missing arguments id, tenant_id; unknown arguments user_id"
+	if err.Error() != expected {
+		t.Errorf("expected %q, got %q", expected, err.Error())
+	}
+
+	_, err = q.PrepareStrict(map[string]interface{}{"name": "alice", "id": 1, "tenant_id": 2, "extra": true})
+	if err == nil || err.Error() != "Query 'update-user': unknown arguments extra" {
+		t.Errorf("expected unknown argument error, got %v", err)
+	}
+
+	resolved := NewQuery("update-user", q.Raw, WithResolver(func(name string) (interface{}, bool) {
+		return 7, name == "tenant_id"
+	}))
+	if _, err := resolved.PrepareStrict(map[string]interface{}{"name": "alice", "id": 1}); err != nil {
+		t.Errorf("expected resolved parameter to count as bound, got %v", err)
+	}
+}
+
+func TestPrepareExpanded(t *testing.T) {
+	q := NewQuery("list-users", "SELECT * FROM users WHERE tenant_id = :tenant_id AND id IN (:ids) AND (:tenant_id IS NULL OR name IN (:names))")
+
+	sql, args, err := q.PrepareExpanded(map[string]interface{}{
+		"tenant_id": 7,
+		"ids":       []int{1, 2, 3},
+		"names":     []string{"alice"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	expected := "-- list-users\nSELECT * FROM users WHERE tenant_id = $1 AND id IN ($2, $3, $4) AND ($1 IS NULL OR name IN ($5))"
+	if sql != expected {
+		t.Errorf("expected %q, got %q", expected, sql)
+	}
+	if !reflect.DeepEqual(args, []interface{}{7, 1, 2, 3, "alice"}) {
+		t.Errorf("unexpected arguments %v", args)
+	}
+	if q.Query() != "-- list-users\nSELECT * FROM users WHERE tenant_id = $1 AND id IN ($2) AND ($1 IS NULL OR name IN ($3))" {
+		t.Errorf("expected stored query to be unchanged, got %q", q.Query())
+	}
+
+	sql, args, err = q.PrepareExpanded(map[string]interface{}{"tenant_id": 7, "ids": []int{}, "names": []byte("raw")})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	expected = "-- list-users\nSELECT * FROM users WHERE tenant_id = $1 AND id IN (NULL) AND ($1 IS NULL OR name IN ($2))"
+	if sql != expected {
+		t.Errorf("expected %q, got %q", expected, sql)
+	}
+	if !reflect.DeepEqual(args, []interface{}{7, []byte("raw")}) {
+		t.Errorf("unexpected arguments %v", args)
+	}
+
+	mysql := NewQuery("list-users", "SELECT * FROM users WHERE id IN (:ids) OR parent_id IN (:ids)", WithDialect(MySQL))
+	sql, args, err = mysql.PrepareExpanded(map[string]interface{}{"ids": []int{1, 2}})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if sql != "-- list-users\nSELECT * FROM users WHERE id IN (?, ?) OR parent_id IN (?, ?)" {
+		t.Errorf("unexpected query %q", sql)
+	}
+	if !reflect.DeepEqual(args, []interface{}{1, 2, 1, 2}) {
+		t.Errorf("unexpected arguments %v", args)
+	}
+
+	if _, _, err := q.PrepareExpanded(map[string]interface{}{"ids": [][]int{{1}}}); err == nil {
+		t.Error("expected error for nested slices")
+	}
+}
+
+func TestInterning(t *testing.T) {
+	var input strings.Builder
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(&input, "-- name: report-%d\nSELECT * FROM events WHERE tenant_id = :tenant_id\n\n", i)
+	}
+
+	for _, interning := range []bool{false, true} {
+		var opts []Option
+		if interning {
+			opts = append(opts, WithInterning())
+		}
+
+		store := NewQueryStore(opts...)
+		if err := store.loadQueriesFromFile("reports.sql", strings.NewReader(input.String())); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		backing := make(map[*byte]bool)
+		for _, name := range store.Names() {
+			backing[unsafe.StringData(store.MustHaveQuery(name).Raw)] = true
+		}
+
+		if interning && len(backing) != 1 {
+			t.Errorf("expected interned queries to share one body, got %d copies", len(backing))
+		}
+		if !interning && len(backing) != 100 {
+			t.Errorf("expected 100 copies without interning, got %d", len(backing))
+		}
+	}
+}
+
+func TestQueriesWithParams(t *testing.T) {
+	input := `-- name: get-user
+SELECT * FROM users WHERE id = :id AND tenant_id = :tenant_id
+
+-- name: delete-user
+DELETE FROM users WHERE tenant_id = :tenant_id AND id = :id
+
+-- name: get-any-user
+SELECT * FROM users WHERE id = :id
+
+-- name: rename-user
+UPDATE users SET name = :name WHERE id = :id AND tenant_id = :tenant_id
+
+-- name: list-users
+SELECT * FROM users`
+
+	store := NewQueryStore()
+	if err := store.loadQueriesFromFile("users.sql", strings.NewReader(input)); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if names := store.QueriesWithParams("tenant_id", "id"); !reflect.DeepEqual(names, []string{"delete-user", "get-user"}) {
+		t.Errorf("unexpected queries %v", names)
+	}
+	if names := store.QueriesWithParams(); !reflect.DeepEqual(names, []string{"list-users"}) {
+		t.Errorf("unexpected queries %v", names)
+	}
+	if names := store.QueriesWithParams("id", "email"); len(names) != 0 {
+		t.Errorf("expected no queries, got %v", names)
+	}
+}
+
+func TestSentinelErrors(t *testing.T) {
+	store := NewQueryStore()
+	if err := store.loadQueriesFromFile("users.sql", strings.NewReader("-- name: get-user\nSELECT * FROM users WHERE id = :id")); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	_, err := store.Query("missing")
+	if !errors.Is(err, ErrQueryNotFound) {
+		t.Errorf("expected ErrQueryNotFound, got %v", err)
+	}
+	if err.Error() != "Query 'missing' not found" {
+		t.Errorf("unexpected message %q", err.Error())
+	}
+
+	func() {
+		defer func() {
+			err, _ := recover().(error)
+			if !errors.Is(err, ErrQueryNotFound) {
+				t.Errorf("expected MustHaveQuery to panic with ErrQueryNotFound, got %v", err)
+			}
+		}()
+		store.MustHaveQuery("missing")
+	}()
+
+	err = store.loadQueriesFromFile("again.sql", strings.NewReader("-- name: get-user\nSELECT 1"))
+	if !errors.Is(err, ErrDuplicateQuery) {
+		t.Errorf("expected ErrDuplicateQuery, got %v", err)
+	}
+	if err.Error() != "Query 'get-user' from again.sql:1 already exists in users.sql:1" {
+		t.Errorf("unexpected message %q", err.Error())
+	}
+
+	dir := t.TempDir()
+	for _, name := range []string{"a.sql", "b.sql"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("-- name: same\nSELECT 1"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := NewQueryStore().LoadFromDir(dir); !errors.Is(err, ErrDuplicateQuery) {
+		t.Errorf("expected LoadFromDir to wrap ErrDuplicateQuery, got %v", err)
+	}
+}
+
+func TestConcurrentLoadAndQuery(t *testing.T) {
+	dirs := make([]string, 2)
+	for i := range dirs {
+		dirs[i] = t.TempDir()
+		for j := 0; j < 20; j++ {
+			content := fmt.Sprintf("-- name: dir%d-query%d\nSELECT * FROM users WHERE id = :id", i, j)
+			if err := os.WriteFile(filepath.Join(dirs[i], fmt.Sprintf("q%d.sql", j)), []byte(content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	store := NewQueryStore()
+
+	var (
+		wg   sync.WaitGroup
+		done = make(chan struct{})
+	)
+
+	for _, dir := range dirs {
+		wg.Add(1)
+		go func(dir string) {
+			defer wg.Done()
+			if err := store.LoadFromDir(dir); err != nil {
+				t.Errorf("LoadFromDir: unexpected error %v", err)
+			}
+		}(dir)
+	}
+
+	reader := make(chan struct{})
+	go func() {
+		defer close(reader)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				store.Query("dir0-query0")
+				store.Names()
+				store.Has("dir1-query19")
+			}
+		}
+	}()
+
+	wg.Wait()
+	close(done)
+	<-reader
+
+	if names := store.Names(); len(names) != 40 {
+		t.Errorf("expected 40 queries, got %d", len(names))
+	}
+}
+
+func TestInvisibleCharacters(t *testing.T) {
+	store := NewQueryStore()
+	err := store.loadQueriesFromFile("users.sql", strings.NewReader("\u00a0-- name: get-user\n\u00a0:id_first = id AND name = :name"))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	q := store.MustHaveQuery("get-user")
+	if !reflect.DeepEqual(q.Mapping, map[string]int{"id_first": 1, "name": 2}) {
+		t.Errorf("unexpected mapping %v", q.Mapping)
+	}
+
+	err = store.loadQueriesFromFile("bad.sql", strings.NewReader("-- name: bad\nSELECT * FROM users WHERE tenant\u200b_id = :id"))
+	if err == nil || !strings.Contains(err.Error(), "Query 'bad'") {
+		t.Errorf("expected error naming the query, got %v", err)
+	}
+}
+
+func TestPrepareStatement(t *testing.T) {
+	q := NewQuery("find-users", "SELECT * FROM users WHERE id = :id::bigint AND name = :name AND tags && :tags::text[] AND parent_id = :id")
+
+	expected := "-- find-users\nPREPARE find_users_stmt (bigint, unknown, text[]) AS SELECT * FROM users WHERE id = $1::bigint AND name = $2 AND tags && $3::text[] AND parent_id = $1"
+	if stmt := q.PrepareStatement("find_users_stmt"); stmt != expected {
+		t.Errorf("expected %q, got %q", expected, stmt)
+	}
+
+	q = NewQuery("list-users", "SELECT * FROM users")
+	if stmt := q.PrepareStatement("list_users_stmt"); stmt != "-- list-users\nPREPARE list_users_stmt AS SELECT * FROM users" {
+		t.Errorf("unexpected statement %q", stmt)
+	}
+}
+
+func TestLoadFromEmbedNestedDuplicates(t *testing.T) {
+	store := NewQueryStore()
+	if err := store.LoadFromEmbed(embedFS, "testdata/embed/users/admin"); err != nil {
+		t.Fatalf("LoadFromEmbed: unexpected error %v", err)
+	}
+
+	err := store.LoadFromEmbed(embedFS, "testdata/embed")
+	if !errors.Is(err, ErrDuplicateQuery) {
+		t.Fatalf("expected duplicate error from the nested directory, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "Error loading SQL file 'testdata/embed/users/admin/") {
+		t.Errorf("expected error naming the nested file, got %v", err)
+	}
+}
+
+func TestReloadEditedDir(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "users.sql")
+	if err := os.WriteFile(file, []byte("-- name: get-user\nSELECT * FROM users WHERE id = :id"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	store := NewQueryStore(WithDuplicatePolicy(DuplicateOverride))
+	if err := store.LoadFromDir(dir); err != nil {
+		t.Fatalf("LoadFromDir: unexpected error %v", err)
+	}
+
+	if err := os.WriteFile(file, []byte("-- name: get-user\nSELECT * FROM users WHERE id = :id AND deleted_at IS NULL"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.LoadFromDir(dir); err != nil {
+		t.Fatalf("reload: unexpected error %v", err)
+	}
+
+	if raw := store.MustHaveQuery("get-user").Raw; raw != "SELECT * FROM users WHERE id = :id AND deleted_at IS NULL" {
+		t.Errorf("expected edited query after reload, got %q", raw)
+	}
+
+	strict := NewQueryStore()
+	if err := strict.LoadFromDir(dir); err != nil {
+		t.Fatalf("LoadFromDir: unexpected error %v", err)
+	}
+	if err := strict.LoadFromDir(dir); !errors.Is(err, ErrDuplicateQuery) {
+		t.Errorf("expected the default policy to reject reloading, got %v", err)
+	}
+}
+
+func TestReloadKeepsGroupOrder(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "setup.sql")
+	write := func(b string) {
+		t.Helper()
+		content := "-- name: a\n-- group: setup\nSELECT 1\n\n-- name: b\n-- group: setup\n" + b + "\n\n-- name: c\n-- group: setup\nSELECT 3"
+		if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("SELECT 2")
+	store := NewQueryStore(WithDuplicatePolicy(DuplicateOverride))
+	if err := store.LoadFromDir(dir); err != nil {
+		t.Fatalf("LoadFromDir: unexpected error %v", err)
+	}
+
+	write("SELECT 2 + 0")
+	if err := store.LoadFromDir(dir); err != nil {
+		t.Fatalf("reload: unexpected error %v", err)
+	}
+
+	queries, err := store.QueriesInGroup("setup")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	names := make([]string, len(queries))
+	for i, q := range queries {
+		names[i] = q.Name
+	}
+	if expected := []string{"a", "b", "c"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected %v, got %v", expected, names)
+	}
+	if raw := store.MustHaveQuery("b").Raw; raw != "SELECT 2 + 0" {
+		t.Errorf("expected edited query after reload, got %q", raw)
+	}
+}
+
+func TestLoadProgress(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "orders"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{
+		"users.sql":        "-- name: get-user\nSELECT * FROM users WHERE id = :id",
+		"accounts.sql":     "-- name: get-account\nSELECT * FROM accounts WHERE id = :id",
+		"orders/get.sql":   "-- name: get-order\nSELECT * FROM orders WHERE id = :id",
+		"orders/README.md": "not a query",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var calls [][2]int
+	store := NewQueryStore(WithProgress(func(loaded, total int) {
+		calls = append(calls, [2]int{loaded, total})
+	}))
+	if err := store.LoadFromDir(dir); err != nil {
+		t.Fatalf("LoadFromDir: unexpected error %v", err)
+	}
+
+	expected := [][2]int{{1, 3}, {2, 3}, {3, 3}}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("expected progress %v, got %v", expected, calls)
+	}
+	if skipped := store.SkippedFiles(); len(skipped) != 1 {
+		t.Errorf("expected the README to be skipped once, got %v", skipped)
+	}
+}
+
+func TestNamesAndLen(t *testing.T) {
+	store := NewQueryStore()
+	if store.Len() != 0 || len(store.Names()) != 0 {
+		t.Errorf("expected empty store, got %d queries %v", store.Len(), store.Names())
+	}
+
+	if err := store.LoadFromEmbed(embedFS, "testdata/embed"); err != nil {
+		t.Fatalf("LoadFromEmbed: unexpected error %v", err)
+	}
+
+	golden := []string{"count", "get", "list-admins", "top"}
+	if names := store.Names(); !reflect.DeepEqual(names, golden) {
+		t.Errorf("Names() = %v; expected %v", names, golden)
+	}
+	if store.Len() != len(golden) {
+		t.Errorf("Len() = %d; expected %d", store.Len(), len(golden))
+	}
+}
+
+func TestParams(t *testing.T) {
+	q := NewQuery("update-user", "UPDATE users SET name = :name, email = :email WHERE id = :id AND :name IS NOT NULL")
+
+	params := q.Params()
+	if !reflect.DeepEqual(params, []string{"name", "email", "id"}) {
+		t.Errorf("unexpected params %v", params)
+	}
+
+	params[0] = "corrupted"
+	if again := q.Params(); again[0] != "name" || q.Mapping["name"] != 1 {
+		t.Errorf("expected Params to return a copy, got %v", again)
+	}
+
+	expanded := NewQuery("update-user", q.Raw, WithExpandRepeats())
+	if params := expanded.Params(); !reflect.DeepEqual(params, []string{"name", "email", "id", "name"}) {
+		t.Errorf("unexpected expanded params %v", params)
+	}
+
+	hand := &Query{Name: "hand", Mapping: map[string]int{"b": 2, "a": 1}}
+	if params := hand.Params(); !reflect.DeepEqual(params, []string{"a", "b"}) {
+		t.Errorf("unexpected params of hand-built query %v", params)
+	}
+}
+
+func TestPrepareFunc(t *testing.T) {
+	q := NewQuery("update-user", "UPDATE users SET name = :name, updated_at = :@now WHERE id = :id")
+
+	var values sync.Map
+	values.Store("name", "alice")
+	values.Store("id", 42)
+
+	var asked []string
+	args, err := q.PrepareFunc(func(name string) (interface{}, bool) {
+		asked = append(asked, name)
+		return values.Load(name)
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(args) != 3 || args[0] != "alice" || args[2] != 42 {
+		t.Errorf("unexpected arguments %v", args)
+	}
+	if _, ok := args[1].(time.Time); !ok {
+		t.Errorf("expected :@now to be generated, got %v", args[1])
+	}
+	if !reflect.DeepEqual(asked, []string{"name", "@now", "id"}) {
+		t.Errorf("expected lookups in ordinal order, got %v", asked)
+	}
+
+	values.Delete("id")
+	_, err = q.PrepareFunc(func(name string) (interface{}, bool) {
+		return values.Load(name)
+	})
+	if err == nil || err.Error() != "Query 'update-user': missing arguments id" {
+		t.Errorf("expected missing argument error, got %v", err)
+	}
+}
+
+func TestOrderedByNumericPrefix(t *testing.T) {
+	load := func(t *testing.T, store *QueryStore, files map[string]string) {
+		t.Helper()
+		for name, content := range files {
+			if err := store.loadQueriesFromFile(name, strings.NewReader(content)); err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+		}
+	}
+
+	files := map[string]string{
+		"0010_add_orders.sql": "CREATE TABLE orders (id int)",
+		"0002_add_users.sql":  "CREATE TABLE users (id int)",
+		"0001_init.sql":       "CREATE SCHEMA app",
+		"helpers.sql":         "-- name: current-version\nSELECT max(version) FROM migrations",
+	}
+
+	store := NewQueryStore()
+	load(t, store, files)
+
+	names, err := store.OrderedByNumericPrefix()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !reflect.DeepEqual(names, []string{"0001_init", "0002_add_users", "0010_add_orders"}) {
+		t.Errorf("unexpected order %v", names)
+	}
+
+	strict := NewQueryStore(WithStrictNumbering())
+	load(t, strict, files)
+	if _, err := strict.OrderedByNumericPrefix(); err == nil || !strings.Contains(err.Error(), "Missing number 3") {
+		t.Errorf("expected gap error, got %v", err)
+	}
+
+	duplicate := NewQueryStore(WithStrictNumbering())
+	load(t, duplicate, map[string]string{
+		"0001_init.sql":      "CREATE SCHEMA app",
+		"0002_add_users.sql": "CREATE TABLE users (id int)",
+		"0002_add_roles.sql": "CREATE TABLE roles (id int)",
+	})
+	_, err = duplicate.OrderedByNumericPrefix()
+	if err == nil || err.Error() != "Queries '0002_add_roles' and '0002_add_users' share the number 2" {
+		t.Errorf("expected duplicate error, got %v", err)
+	}
+}
+
+func TestReservedNames(t *testing.T) {
+	sql := "SELECT to_char(ts, 'x'), to_char(ts, YYYY:MM:DD), :ss AS ss FROM t WHERE id = :id"
+
+	q := NewQuery("default", sql)
+	if !reflect.DeepEqual(q.Mapping, map[string]int{"MM": 1, "DD": 2, "ss": 3, "id": 4}) {
+		t.Errorf("unexpected default mapping %v", q.Mapping)
+	}
+
+	q = NewQuery("custom", sql, WithReservedNames([]string{"YYYY", "MM", "DD"}))
+	if !reflect.DeepEqual(q.Mapping, map[string]int{"ss": 1, "id": 2}) {
+		t.Errorf("unexpected custom mapping %v", q.Mapping)
+	}
+	if !strings.Contains(q.Query(), "to_char(ts, YYYY:MM:DD)") {
+		t.Errorf("expected reserved tokens to be kept, got %q", q.Query())
+	}
+
+	q = NewQuery("case", "SELECT to_char(ts, HH24:mi:ss) FROM t WHERE id = :id", WithReservedNamesIgnoreCase())
+	if !reflect.DeepEqual(q.Mapping, map[string]int{"id": 1}) {
+		t.Errorf("unexpected case-insensitive mapping %v", q.Mapping)
+	}
+
+	store := NewQueryStore(WithReservedNames([]string{"HH"}))
+	if err := store.loadQueriesFromFile("t.sql", strings.NewReader("-- name: t\nSELECT to_char(ts, YYYY:HH) FROM t WHERE x = :MI")); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if mapping := store.MustHaveQuery("t").Mapping; !reflect.DeepEqual(mapping, map[string]int{"MI": 1}) {
+		t.Errorf("expected the store option to reach the queries, got %v", mapping)
+	}
+}
+
+func TestUpsertParams(t *testing.T) {
+	q := NewQuery("upsert", "INSERT INTO t (id, name) VALUES (:id, :name) ON CONFLICT (id) DO UPDATE SET name = :name WHERE t.v = :v")
+
+	expectedMapping := map[string]int{"id": 1, "name": 2, "v": 3}
+	if !reflect.DeepEqual(q.Mapping, expectedMapping) {
+		t.Errorf("unexpected mapping %v", q.Mapping)
+	}
+
+	expected := "-- upsert\nINSERT INTO t (id, name) VALUES ($1, $2) ON CONFLICT (id) DO UPDATE SET name = $2 WHERE t.v = $3"
+	if q.Query() != expected {
+		t.Errorf("expected %q, got %q", expected, q.Query())
+	}
+}
+
+func TestEscapedColon(t *testing.T) {
+	q := NewQuery("escaped", `SELECT '\:x', tag FROM t WHERE tag = 'a:b' AND label = \:notaparam || :suffix AND since > now() - interval '1:30'`)
+
+	if expected := map[string]int{"suffix": 1}; !reflect.DeepEqual(q.Mapping, expected) {
+		t.Errorf("unexpected mapping %v", q.Mapping)
+	}
+
+	expected := `-- escaped
+SELECT '\:x', tag FROM t WHERE tag = 'a:b' AND label = :notaparam || $1 AND since > now() - interval '1:30'`
+	if q.Query() != expected {
+		t.Errorf("expected %q, got %q", expected, q.Query())
+	}
+
+	if err := q.Validate(); err != nil {
+		t.Errorf("escaped colon reported by Validate: %v", err)
+	}
+
+	sql, _, err := q.PrepareExpanded(map[string]interface{}{"suffix": "x"})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if sql != expected {
+		t.Errorf("PrepareExpanded: expected %q, got %q", expected, sql)
+	}
+}
+
+func TestDefaults(t *testing.T) {
+	input := `-- name: list-users
+-- default limit: 50
+-- default status: 'it''s active'
+-- default team: NULL
+-- default sort: name
+SELECT * FROM users WHERE status = :status AND team = :team ORDER BY :sort LIMIT :limit`
+
+	store := NewQueryStore()
+	if err := store.loadQueriesFromFile("users.sql", strings.NewReader(input)); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	q := store.MustHaveQuery("list-users")
+	expected := map[string]interface{}{"limit": int64(50), "status": "it's active", "team": nil, "sort": "name"}
+	if !reflect.DeepEqual(q.Defaults, expected) {
+		t.Errorf("Defaults: expected %v, got %v", expected, q.Defaults)
+	}
+	if strings.Contains(q.Raw, "default") {
+		t.Errorf("default declarations leaked into the query: %q", q.Raw)
+	}
+
+	args := q.Prepare(map[string]interface{}{"limit": 10})
+	if !reflect.DeepEqual(args, []interface{}{"it's active", nil, "name", 10}) {
+		t.Errorf("unexpected arguments %v", args)
+	}
+
+	if _, err := q.PrepareStrict(map[string]interface{}{}); err != nil {
+		t.Errorf("PrepareStrict: parameters with defaults reported missing: %v", err)
+	}
+}
+
+func TestLoadFromFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"sql/users.sql":         {Data: []byte("-- name: get-user\nSELECT * FROM users WHERE id = :id")},
+		"sql/reports/sales.sql": {Data: []byte("SELECT * FROM sales WHERE day = :day")},
+		"sql/README.md":         {Data: []byte("# queries")},
+	}
+
+	store := NewQueryStore(WithPathNames("."))
+	if err := store.LoadFromFS(fsys, "sql/"); err != nil {
+		t.Fatalf("LoadFromFS: unexpected error %v", err)
+	}
+
+	if names := store.Names(); !reflect.DeepEqual(names, []string{"get-user", "reports.sales"}) {
+		t.Errorf("Names() = %v", names)
+	}
+	if source := store.MustHaveQuery("reports.sales").Source; source != "sql/reports/sales.sql" {
+		t.Errorf("unexpected source %s", source)
+	}
+	if skipped := store.SkippedFiles(); !reflect.DeepEqual(skipped, []string{"sql/README.md"}) {
+		t.Errorf("SkippedFiles() = %v", skipped)
+	}
+}
+
+func TestQueriesInGroup(t *testing.T) {
+	input := `-- name: create_schema
+-- group: setup
+CREATE SCHEMA app
+
+-- name: get-user
+SELECT * FROM app.users WHERE id = :id
+
+-- name: create_index_b
+-- group: setup
+CREATE INDEX b ON app.users (b)
+
+-- name: create_index_a
+-- group: setup
+CREATE INDEX a ON app.users (a)`
+
+	store := NewQueryStore()
+	if err := store.loadQueriesFromFile("setup.sql", strings.NewReader(input)); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := store.loadQueriesFromFile("more.sql", strings.NewReader("-- name: analyze\n-- group: setup\nANALYZE")); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	for i := 0; i < 10; i++ {
+		queries, err := store.QueriesInGroup("setup")
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		names := make([]string, len(queries))
+		for i, q := range queries {
+			names[i] = q.Name
+		}
+		if expected := []string{"create_schema", "create_index_b", "create_index_a", "analyze"}; !reflect.DeepEqual(names, expected) {
+			t.Fatalf("expected %v, got %v", expected, names)
+		}
+	}
+
+	if _, err := store.QueriesInGroup("teardown"); !errors.Is(err, ErrQueryNotFound) {
+		t.Errorf("expected ErrQueryNotFound, got %v", err)
+	}
+}
+
+func TestRender(t *testing.T) {
+	q := NewQuery("search", "SELECT * FROM users WHERE name = :name AND age > :age AND score < :score AND active = :active AND team = :team AND avatar = :avatar AND created_at > :since AND label = \\:literal AND name <> :name")
+
+	name := "O'Brien"
+	rendered, err := q.Render(map[string]interface{}{
+		"name":   &name,
+		"age":    30,
+		"score":  1.5,
+		"active": true,
+		"team":   nil,
+		"avatar": []byte{0xca, 0xfe},
+		"since":  time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	expected := "-- search\nSELECT * FROM users WHERE name = 'O''Brien' AND age > 30 AND score < 1.5 AND active = TRUE AND team = NULL AND avatar = '\\xcafe' AND created_at > '2024-01-02T03:04:05Z' AND label = :literal AND name <> 'O''Brien'"
+	if rendered != expected {
+		t.Errorf("expected %q, got %q", expected, rendered)
+	}
+
+	if _, err := q.Render(map[string]interface{}{"name": struct{}{}}); err == nil || !strings.Contains(err.Error(), "argument 'name' of type struct {} cannot be rendered") {
+		t.Errorf("expected render error, got %v", err)
+	}
+}
+
+func TestSourceLine(t *testing.T) {
+	input := `
+SELECT 1
+
+-- name: get-user
+-- tx: false
+SELECT * FROM users WHERE id = :id
+
+-- name: list-users
+SELECT * FROM users`
+
+	store := NewQueryStore()
+	if err := store.loadQueriesFromFile("users.sql", strings.NewReader(input)); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	for name, line := range map[string]int{"users": 2, "get-user": 4, "list-users": 8} {
+		q := store.MustHaveQuery(name)
+		if q.Source != "users.sql" || q.SourceLine != line {
+			t.Errorf("%s: expected users.sql:%d, got %s:%d", name, line, q.Source, q.SourceLine)
+		}
+	}
+
+	err := store.loadQueriesFromFile("more.sql", strings.NewReader("-- name: other\nSELECT 2\n\n-- name: list-users\nSELECT 3"))
+	if err == nil || err.Error() != "Query 'list-users' from more.sql:4 already exists in users.sql:8" {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestCompile(t *testing.T) {
+	input := `-- name: get-user
+SELECT * FROM users WHERE id = :id
+
+-- name: ambiguous
+SELECT * FROM users WHERE id = :userID OR id = :userid
+
+-- name: dangling
+SELECT * FROM users WHERE name = :Name`
+
+	store := NewQueryStore(WithParamPattern("[a-z][A-Za-z0-9_]*"))
+	if err := store.loadQueriesFromFile("users.sql", strings.NewReader(input)); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	err := store.Compile()
+	expected := "Query 'ambiguous' has parameters 'userID' and 'userid' differing only in case\nQuery 'dangling' has unreplaced parameters :Name"
+	if err == nil || err.Error() != expected {
+		t.Errorf("expected %q, got %v", expected, err)
+	}
+
+	func() {
+		defer func() {
+			if recovered := recover(); recovered == nil {
+				t.Error("expected MustCompile to panic")
+			}
+		}()
+		store.MustCompile()
+	}()
+
+	healthy := NewQueryStore()
+	if err := healthy.loadQueriesFromFile("users.sql", strings.NewReader("-- name: get-user\nSELECT * FROM users WHERE id = :id")); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := healthy.Compile(); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestLoadFromZipFS(t *testing.T) {
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	for name, content := range map[string]string{
+		"queries/users.sql":        "-- name: get-user\nSELECT * FROM users WHERE id = :id",
+		"queries/billing/list.sql": "-- name: list-invoices\nSELECT * FROM invoices",
+	} {
+		w, err := archive.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	zipFS, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := NewQueryStore()
+	if err := store.LoadFromFS(zipFS, "queries"); err != nil {
+		t.Fatalf("LoadFromFS: unexpected error %v", err)
+	}
+	if names := store.Names(); !reflect.DeepEqual(names, []string{"get-user", "list-invoices"}) {
+		t.Errorf("Names() = %v", names)
+	}
+}
@@ -3,19 +3,42 @@ package queries
 
 import (
 	"bufio"
+	"fmt"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
 type Scanner struct {
-	line    string
-	queries map[string]string
+	// name of the statements preceding the first name tag, defaults to the
+	// base file name
+	name string
+	// comments holds the markers starting comments stripped from the
+	// query text, e.g. "#" for MySQL
+	comments []string
+
+	line     string
+	queries  map[string]string
+	metadata map[string]map[string]string
+	defaults map[string]map[string]string
+	// order holds the query names in the order of their first statement
+	order []string
+	// lines holds the line of the name tag, or of the first statement, of
+	// each query
+	lines   map[string]int
+	lineNo  int
 	current string
 }
 
 type stateFn func(*Scanner) stateFn
 
+var (
+	metadataRE = regexp.MustCompile(`^\s*--\s*([A-Za-z][A-Za-z0-9_-]*):\s*(.*?)\s*$`)
+	defaultRE  = regexp.MustCompile(`^\s*--\s*default\s+(@?[A-Za-z_][A-Za-z0-9_]*):\s*(.*?)\s*$`)
+)
+
 func getTag(line string) string {
 	re := regexp.MustCompile("^\\s*--\\s*name:\\s*(\\S+)")
 	matches := re.FindStringSubmatch(line)
@@ -25,30 +48,114 @@ func getTag(line string) string {
 	return matches[1]
 }
 
+// getMetadata returns the key and value of a `-- key: value` line
+func getMetadata(line string) (string, string, bool) {
+	matches := metadataRE.FindStringSubmatch(line)
+	if matches == nil {
+		return "", "", false
+	}
+	return matches[1], matches[2], true
+}
+
+// getDefault returns the parameter and value of a `-- default name: value`
+// line
+func getDefault(line string) (string, string, bool) {
+	matches := defaultRE.FindStringSubmatch(line)
+	if matches == nil {
+		return "", "", false
+	}
+	return matches[1], matches[2], true
+}
+
 func initialState(s *Scanner) stateFn {
 	if tag := getTag(s.line); len(tag) > 0 {
-		s.current = tag
-		return queryState
+		s.startQuery(tag)
+		return metadataState
 	}
 	return initialState
 }
 
+// metadataState collects `-- key: value` lines following the name tag until
+// the first line of the query itself
+func metadataState(s *Scanner) stateFn {
+	if tag := getTag(s.line); len(tag) > 0 {
+		s.startQuery(tag)
+		return metadataState
+	}
+
+	if key, value, ok := getMetadata(s.line); ok {
+		s.appendMetadata(key, value)
+		return metadataState
+	}
+
+	if name, value, ok := getDefault(s.line); ok {
+		s.appendDefault(name, value)
+		return metadataState
+	}
+
+	if len(strings.TrimSpace(s.line)) == 0 {
+		return metadataState
+	}
+
+	s.appendQueryLine()
+	return queryState
+}
+
 func queryState(s *Scanner) stateFn {
 	if tag := getTag(s.line); len(tag) > 0 {
-		s.current = tag
-	} else {
-		s.appendQueryLine()
+		s.startQuery(tag)
+		return metadataState
 	}
+
+	s.appendQueryLine()
 	return queryState
 }
 
+// startQuery makes the tagged query the current one
+func (s *Scanner) startQuery(tag string) {
+	s.current = tag
+	s.markLine()
+}
+
+// markLine records the current line as the start of the current query
+func (s *Scanner) markLine() {
+	if _, ok := s.lines[s.current]; !ok {
+		s.lines[s.current] = s.lineNo
+	}
+}
+
+func (s *Scanner) appendMetadata(key, value string) {
+	metadata, ok := s.metadata[s.current]
+	if !ok {
+		metadata = make(map[string]string)
+		s.metadata[s.current] = metadata
+	}
+
+	metadata[key] = value
+}
+
+func (s *Scanner) appendDefault(name, value string) {
+	defaults, ok := s.defaults[s.current]
+	if !ok {
+		defaults = make(map[string]string)
+		s.defaults[s.current] = defaults
+	}
+
+	defaults[name] = value
+}
+
 func (s *Scanner) appendQueryLine() {
-	current := s.queries[s.current]
-	line := strings.Trim(s.line, " \t")
+	current, ok := s.queries[s.current]
+	line := strings.Trim(stripComment(s.line, s.comments), " \t")
 	if len(line) == 0 {
 		return
 	}
 
+	if !ok {
+		s.order = append(s.order, s.current)
+		s.markLine()
+	}
+
 	if len(current) > 0 {
 		current = current + "\n"
 	}
@@ -57,15 +164,119 @@ func (s *Scanner) appendQueryLine() {
 	s.queries[s.current] = current
 }
 
+// stripComment cuts the line at the first comment marker found outside of
+// quoted text
+func stripComment(line string, markers []string) string {
+	if len(markers) == 0 {
+		return line
+	}
+
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		default:
+			for _, marker := range markers {
+				if strings.HasPrefix(line[i:], marker) {
+					return line[:i]
+				}
+			}
+		}
+	}
+
+	return line
+}
+
 func (s *Scanner) Run(fileName string, io *bufio.Scanner) map[string]string {
 	s.queries = make(map[string]string)
+	s.metadata = make(map[string]map[string]string)
+	s.defaults = make(map[string]map[string]string)
+	s.order = nil
+	s.lines = make(map[string]int)
+	s.lineNo = 0
 
-	s.current = filepath.Base(strings.TrimSuffix(fileName, filepath.Ext(fileName)))
+	s.current = s.name
+	if len(s.current) == 0 {
+		s.current = filepath.Base(strings.TrimSuffix(fileName, filepath.Ext(fileName)))
+	}
 
-	for state := queryState; io.Scan(); {
-		s.line = io.Text()
+	for state := metadataState; io.Scan(); {
+		s.lineNo++
+		s.line = trimLeadingInvisible(io.Text())
 		state = state(s)
 	}
 
 	return s.queries
 }
+
+// isInvisible reports whether r is a zero-width or non-breaking character
+// commonly left behind by copy-pasting
+func isInvisible(r rune) bool {
+	switch r {
+	case '\u00a0', '\u200b', '\u200c', '\u200d', '\u2060', '\ufeff':
+		return true
+	}
+
+	return false
+}
+
+// trimLeadingInvisible drops the whitespace and invisible characters before
+// the first token of the line, so they don't hide name tags or parameters
+func trimLeadingInvisible(line string) string {
+	return strings.TrimLeftFunc(line, func(r rune) bool {
+		return unicode.IsSpace(r) || isInvisible(r)
+	})
+}
+
+// checkInvisible rejects invisible characters within identifiers outside of
+// literals and comments, e.g. a zero-width space in user\u200bid
+func checkInvisible(sql string) error {
+	for i := 0; i < len(sql); {
+		c := sql[i]
+
+		switch {
+		case c == '\'' || c == '"':
+			i = skipQuoted(sql, i, c)
+		case c == '$':
+			i = skipDollarQuoted(sql, i)
+		case strings.HasPrefix(sql[i:], "--"):
+			i = skipLineComment(sql, i)
+		case strings.HasPrefix(sql[i:], "/*"):
+			i = skipBlockComment(sql, i)
+		case c >= utf8.RuneSelf:
+			r, size := utf8.DecodeRuneInString(sql[i:])
+			if isInvisible(r) && i > 0 && isWordChar(sql[i-1]) && i+size < len(sql) && isWordChar(sql[i+size]) {
+				return fmt.Errorf("invisible character %U within identifier near '%s'", r, identifierAround(sql, i, i+size))
+			}
+			i += size
+		default:
+			i++
+		}
+	}
+
+	return nil
+}
+
+// identifierAround returns the word characters surrounding sql[start:end]
+func identifierAround(sql string, start, end int) string {
+	for start > 0 && isWordChar(sql[start-1]) {
+		start--
+	}
+	for end < len(sql) && isWordChar(sql[end]) {
+		end++
+	}
+
+	return strings.Map(func(r rune) rune {
+		if isInvisible(r) {
+			return -1
+		}
+		return r
+	}, sql[start:end])
+}
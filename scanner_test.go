@@ -0,0 +1,79 @@
+package queries
+
+import (
+	"bufio"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestScannerMetadata(t *testing.T) {
+	input := `-- name: get-user
+-- schema: app
+-- owner: billing
+
+SELECT *
+-- inline: comment stays in query
+FROM users
+
+-- name: list-users
+SELECT * FROM users
+`
+
+	scanner := &Scanner{}
+	queries := scanner.Run("users.sql", bufio.NewScanner(strings.NewReader(input)))
+
+	expectedQueries := map[string]string{
+		"get-user":   "SELECT *\n-- inline: comment stays in query\nFROM users",
+		"list-users": "SELECT * FROM users",
+	}
+	if !reflect.DeepEqual(queries, expectedQueries) {
+		t.Errorf("queries: got %v, expected %v", queries, expectedQueries)
+	}
+
+	expectedMetadata := map[string]map[string]string{
+		"get-user": {"schema": "app", "owner": "billing"},
+	}
+	if !reflect.DeepEqual(scanner.metadata, expectedMetadata) {
+		t.Errorf("metadata: got %v, expected %v", scanner.metadata, expectedMetadata)
+	}
+}
+
+func TestScannerCommentMarkers(t *testing.T) {
+	input := `-- name: get-user
+# lookup by :legacy_id is gone
+SELECT * FROM users # filtered by :ignored
+WHERE id = :id AND note = 'a # b'
+# trailing note: :other`
+
+	scanner := &Scanner{comments: []string{"#"}}
+	queries := scanner.Run("users.sql", bufio.NewScanner(strings.NewReader(input)))
+
+	expected := "SELECT * FROM users\nWHERE id = :id AND note = 'a # b'"
+	if queries["get-user"] != expected {
+		t.Errorf("got %q, expected %q", queries["get-user"], expected)
+	}
+}
+
+func TestScannerInvisibleCharacters(t *testing.T) {
+	input := "\u00a0-- name: get-user\n\u200b\u00a0SELECT * FROM users\n\u00a0\u00a0WHERE id = :id"
+
+	scanner := &Scanner{}
+	queries := scanner.Run("users.sql", bufio.NewScanner(strings.NewReader(input)))
+
+	expected := map[string]string{"get-user": "SELECT * FROM users\nWHERE id = :id"}
+	if !reflect.DeepEqual(queries, expected) {
+		t.Errorf("got %q, expected %q", queries, expected)
+	}
+}
+
+func TestCheckInvisible(t *testing.T) {
+	if err := checkInvisible("SELECT 'a\u200bb' FROM users -- x\u200by\nWHERE id = :id"); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	err := checkInvisible("SELECT * FROM users WHERE user\u200bid = :id")
+	if err == nil || !strings.Contains(err.Error(), "U+200B") || !strings.Contains(err.Error(), "'userid'") {
+		t.Errorf("expected error naming the character and identifier, got %v", err)
+	}
+}
@@ -0,0 +1,5 @@
+-- name: get-invoice
+SELECT * FROM invoices WHERE id = :id
+
+-- name: list-invoices
+SELECT * FROM invoices WHERE customer_id = :customer_id
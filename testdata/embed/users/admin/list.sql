@@ -0,0 +1,2 @@
+-- name: list-admins
+SELECT * FROM admins
@@ -0,0 +1,186 @@
+package queries
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// watchedFile is the version of a query file seen by WatchDir
+type watchedFile struct {
+	rel     string
+	modTime time.Time
+	size    int64
+}
+
+// WatchDir polls the query files under path every interval and reloads the
+// changed ones until ctx is cancelled, e.g. to pick up edits during
+// development. The store is expected to be loaded from path already. The
+// queries of a changed file are swapped at once; when the file fails to load
+// its previous queries are kept and the error is passed to onError. Queries
+// of removed files are dropped. Changes are detected by comparing the
+// modification time and size of the files on every poll, not from file
+// system events (as fsnotify would), to keep the package free of
+// dependencies, so an edit shows up only after the next interval. Errors are
+// ignored when onError is nil
+func (s *QueryStore) WatchDir(ctx context.Context, path string, interval time.Duration, onError func(err error)) error {
+	if interval <= 0 {
+		return fmt.Errorf("Watch interval must be positive, got %v", interval)
+	}
+	if onError == nil {
+		onError = func(err error) {}
+	}
+
+	files, err := s.watchedFiles(path)
+	if err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		files = s.pollDir(path, files, onError)
+	}
+}
+
+// pollDir reloads the files changed since the previous poll, which found
+// files, and returns the current files
+func (s *QueryStore) pollDir(path string, files map[string]watchedFile, onError func(err error)) map[string]watchedFile {
+	current, err := s.watchedFiles(path)
+	if err != nil {
+		onError(err)
+		return files
+	}
+
+	for fileName, file := range current {
+		previous, ok := files[fileName]
+		if ok && previous.size == file.size && previous.modTime.Equal(file.modTime) {
+			continue
+		}
+
+		if err := s.reloadFile(fileName, file.rel); err != nil {
+			onError(err)
+		}
+	}
+
+	for fileName := range files {
+		if _, ok := current[fileName]; !ok {
+			s.dropSource(fileName)
+		}
+	}
+
+	return current
+}
+
+// watchedFiles returns the query files LoadFromDir would load from path
+func (s *QueryStore) watchedFiles(path string) (map[string]watchedFile, error) {
+	files := make(map[string]watchedFile)
+
+	err := s.walkDir(path, path, path, make(map[string]bool), func(virtualPath, rel string) error {
+		if s.excluded(virtualPath) || !s.isQueryFile(virtualPath) {
+			return nil
+		}
+
+		info, err := os.Stat(virtualPath)
+		if err != nil {
+			return err
+		}
+
+		files[virtualPath] = watchedFile{
+			rel:     filepath.ToSlash(rel),
+			modTime: info.ModTime(),
+			size:    info.Size(),
+		}
+
+		return nil
+	})
+
+	return files, err
+}
+
+// reloadFile loads the file into a staging store and replaces the queries
+// previously loaded from it. The store is left untouched on error
+func (s *QueryStore) reloadFile(fileName, rel string) error {
+	staged := &QueryStore{
+		queries: make(map[string]*Query),
+		uses:    make(map[string]*int64),
+		opts:    s.opts,
+	}
+
+	if err := staged.loadFile(fileName, staged.pathName(rel), staged.namespace(rel)); err != nil {
+		return fmt.Errorf("Error loading SQL file '%s': %w", fileName, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count := len(s.queries)
+	for name, q := range s.queries {
+		if q.Source == fileName && staged.queries[name] == nil {
+			count--
+		}
+	}
+
+	for name, q := range staged.queries {
+		existing, ok := s.queries[name]
+		if !ok {
+			count++
+			continue
+		}
+
+		if existing.Source != fileName && s.opts.duplicates == DuplicateError {
+			return fmt.Errorf("Error loading SQL file '%s': Query '%s' from %s %w in %s", fileName, name, q.location(), ErrDuplicateQuery, existing.location())
+		}
+	}
+
+	if max := s.opts.maxQueries; max > 0 && count > max {
+		return fmt.Errorf("Error loading SQL file '%s': exceeds the limit of %d queries", fileName, max)
+	}
+
+	for name, q := range s.queries {
+		if q.Source == fileName && staged.queries[name] == nil {
+			delete(s.queries, name)
+			delete(s.uses, name)
+		}
+	}
+
+	for name, q := range staged.queries {
+		existing, ok := s.queries[name]
+		switch {
+		case !ok:
+			s.loaded++
+			q.seq = s.loaded
+			s.uses[name] = new(int64)
+		case sameDefinition(existing, q):
+			continue
+		default:
+			q.seq = existing.seq
+		}
+
+		s.queries[name] = q
+	}
+
+	return nil
+}
+
+// dropSource removes the queries loaded from the file
+func (s *QueryStore) dropSource(fileName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for name, q := range s.queries {
+		if q.Source == fileName {
+			delete(s.queries, name)
+			delete(s.uses, name)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package queries
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWatchDir(t *testing.T) {
+	dir := t.TempDir()
+	users := filepath.Join(dir, "users.sql")
+	orders := filepath.Join(dir, "orders.sql")
+
+	// every write moves the modification time forward, so the change is
+	// noticed regardless of the filesystem timestamp resolution
+	stamp := time.Now()
+	write := func(path, content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		stamp = stamp.Add(time.Second)
+		if err := os.Chtimes(path, stamp, stamp); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(users, "-- name: get-user\nSELECT * FROM users WHERE id = :id\n\n-- name: list-users\nSELECT * FROM users")
+	write(orders, "-- name: get-order\nSELECT * FROM orders WHERE id = :id")
+
+	store := NewQueryStore()
+	if err := store.LoadFromDir(dir); err != nil {
+		t.Fatalf("LoadFromDir: unexpected error %v", err)
+	}
+
+	files, err := store.watchedFiles(dir)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	var errs []error
+	poll := func() {
+		errs = nil
+		files = store.pollDir(dir, files, func(err error) { errs = append(errs, err) })
+	}
+
+	unchanged := store.MustHaveQuery("get-order")
+	write(users, "-- name: get-user\nSELECT * FROM users WHERE id = :id AND active")
+	poll()
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors %v", errs)
+	}
+	if q := store.MustHaveQuery("get-user"); !strings.HasSuffix(q.Raw, "AND active") {
+		t.Errorf("the edited query was not reloaded, got %q", q.Raw)
+	}
+	if store.Has("list-users") {
+		t.Error("query removed from the file is still loaded")
+	}
+	if store.MustHaveQuery("get-order") != unchanged {
+		t.Error("query of an unchanged file was reloaded")
+	}
+
+	write(users, "-- name: get-user\n-- style: bogus\nSELECT * FROM users")
+	poll()
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "unknown placeholder style 'bogus'") {
+		t.Errorf("expected the reload error, got %v", errs)
+	}
+	if q := store.MustHaveQuery("get-user"); !strings.HasSuffix(q.Raw, "AND active") {
+		t.Errorf("the previous version was not kept, got %q", q.Raw)
+	}
+
+	write(orders, "-- name: get-user\nSELECT 1")
+	poll()
+	if len(errs) != 1 || !errors.Is(errs[0], ErrDuplicateQuery) {
+		t.Errorf("expected duplicate error, got %v", errs)
+	}
+	if !store.Has("get-order") {
+		t.Error("the previous version of orders.sql was not kept")
+	}
+
+	if err := os.Remove(orders); err != nil {
+		t.Fatal(err)
+	}
+	poll()
+	if store.Has("get-order") {
+		t.Error("query of the removed file is still loaded")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := store.WatchDir(ctx, dir, time.Millisecond, func(err error) {}); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if err := store.WatchDir(ctx, dir, 0, func(err error) {}); err == nil || !strings.Contains(err.Error(), "Watch interval must be positive, got 0s") {
+		t.Errorf("expected interval error, got %v", err)
+	}
+
+	// a failed reload is ignored without onError
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	done := make(chan error)
+	go func() {
+		done <- store.WatchDir(ctx, dir, time.Millisecond, nil)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	write(users, "-- name: get-user\n-- style: bogus\nSELECT * FROM users")
+	if err := <-done; !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+}